@@ -16,106 +16,102 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
-        "strings"
-        "strconv"
-        "regexp"
-        "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+	"strings"
 )
 
-func AccountsData() []byte {
-        cmd := exec.Command("squeue","-a","-r","-h","-o %A|%a|%T|%C")
-        stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
-}
-
 type JobMetrics struct {
-        pending float64
-        running float64
-        running_cpus float64
-        suspended float64
+	pending      float64
+	running      float64
+	running_cpus float64
+	suspended    float64
 }
 
-func ParseAccountsMetrics(input []byte) map[string]*JobMetrics {
-        accounts := make(map[string]*JobMetrics)
-        lines := strings.Split(string(input), "\n")
-        for _, line := range lines {
-                if strings.Contains(line,"|") {
-                        account := strings.Split(line,"|")[1]
-                        _,key := accounts[account]
-                        if !key {
-                                accounts[account] = &JobMetrics{0,0,0,0}
-                        }
-                        state := strings.Split(line,"|")[2]
-                        state = strings.ToLower(state)
-                        cpus,_ := strconv.ParseFloat(strings.Split(line,"|")[3],64)
-                        pending := regexp.MustCompile(`^pending`)
-                        running := regexp.MustCompile(`^running`)
-                        suspended := regexp.MustCompile(`^suspended`)
-                        switch {
-                        case pending.MatchString(state) == true:
-                                accounts[account].pending++
-                        case running.MatchString(state) == true:
-                                accounts[account].running++
-                                accounts[account].running_cpus += cpus
-                        case suspended.MatchString(state) == true:
-                                accounts[account].suspended++
-                        }
-                }
-        }
-        return accounts
+func ParseAccountsMetrics(jobs []Job) map[string]*JobMetrics {
+	accounts := make(map[string]*JobMetrics)
+	pending := regexp.MustCompile(`^pending`)
+	running := regexp.MustCompile(`^running`)
+	suspended := regexp.MustCompile(`^suspended`)
+	for _, job := range jobs {
+		account := job.account
+		_, key := accounts[account]
+		if !key {
+			accounts[account] = &JobMetrics{0, 0, 0, 0}
+		}
+		state := strings.ToLower(job.state)
+		switch {
+		case pending.MatchString(state) == true:
+			accounts[account].pending++
+		case running.MatchString(state) == true:
+			accounts[account].running++
+			accounts[account].running_cpus += job.cpus
+		case suspended.MatchString(state) == true:
+			accounts[account].suspended++
+		}
+	}
+	return accounts
 }
 
 type AccountsCollector struct {
-        pending *prometheus.Desc
-        running *prometheus.Desc
-        running_cpus *prometheus.Desc
-        suspended *prometheus.Desc
+	jobs         *JobsSnapshot
+	limit        *CardinalityLimit
+	pending      *prometheus.Desc
+	running      *prometheus.Desc
+	running_cpus *prometheus.Desc
+	suspended    *prometheus.Desc
 }
 
-func NewAccountsCollector() *AccountsCollector {
-        labels := []string{"account"}
-        return &AccountsCollector{
-                pending: prometheus.NewDesc("slurm_account_jobs_pending", "Pending jobs for account", labels, nil),
-                running: prometheus.NewDesc("slurm_account_jobs_running", "Running jobs for account", labels, nil),
-                running_cpus: prometheus.NewDesc("slurm_account_cpus_running", "Running cpus for account", labels, nil),
-                suspended: prometheus.NewDesc("slurm_account_jobs_suspended", "Suspended jobs for account", labels, nil),
-        }
+func NewAccountsCollector(jobs *JobsSnapshot) *AccountsCollector {
+	labels := []string{"account"}
+	return &AccountsCollector{
+		jobs:         jobs,
+		pending:      prometheus.NewDesc("slurm_account_jobs_pending", "Pending jobs for account", labels, nil),
+		running:      prometheus.NewDesc("slurm_account_jobs_running", "Running jobs for account", labels, nil),
+		running_cpus: prometheus.NewDesc("slurm_account_cpus_running", "Running cpus for account", labels, nil),
+		suspended:    prometheus.NewDesc("slurm_account_jobs_suspended", "Suspended jobs for account", labels, nil),
+	}
 }
 
 func (ac *AccountsCollector) Describe(ch chan<- *prometheus.Desc) {
-        ch <- ac.pending
-        ch <- ac.running
-        ch <- ac.running_cpus
-        ch <- ac.suspended
+	ch <- ac.pending
+	ch <- ac.running
+	ch <- ac.running_cpus
+	ch <- ac.suspended
 }
 
-func (ac *AccountsCollector) Collect(ch chan<- prometheus.Metric) {
-        am := ParseAccountsMetrics(AccountsData())
-        for a := range am {
-                if am[a].pending > 0 {
-                        ch <- prometheus.MustNewConstMetric(ac.pending, prometheus.GaugeValue, am[a].pending, a)
-                }
-                if am[a].running > 0 {
-                        ch <- prometheus.MustNewConstMetric(ac.running, prometheus.GaugeValue, am[a].running, a)
-                }
-                if am[a].running_cpus > 0 {
-                        ch <- prometheus.MustNewConstMetric(ac.running_cpus, prometheus.GaugeValue, am[a].running_cpus, a)
-                }
-                if am[a].suspended > 0 {
-                        ch <- prometheus.MustNewConstMetric(ac.suspended, prometheus.GaugeValue, am[a].suspended, a)
-                }
-        }
+// Limit the series to the accounts selected, see cardinality.go
+func (ac *AccountsCollector) SetCardinalityLimit(limit *CardinalityLimit) {
+	ac.limit = limit
+}
+
+// Execute squeue again on the next update
+func (ac *AccountsCollector) Reset() {
+	ac.jobs.Reset()
+}
+
+func (ac *AccountsCollector) Update(ch chan<- prometheus.Metric) error {
+	jobs, err := ac.jobs.Jobs()
+	if err != nil {
+		return err
+	}
+	ac.jobs.countParseErrors("accounts")
+	countCPUsParseErrors("accounts", jobs)
+	am, dropped := ac.limit.Apply(ParseAccountsMetrics(jobs))
+	seriesDroppedTotal.WithLabelValues("accounts").Add(float64(dropped))
+	for a := range am {
+		if am[a].pending > 0 {
+			ch <- prometheus.MustNewConstMetric(ac.pending, prometheus.GaugeValue, am[a].pending, a)
+		}
+		if am[a].running > 0 {
+			ch <- prometheus.MustNewConstMetric(ac.running, prometheus.GaugeValue, am[a].running, a)
+		}
+		if am[a].running_cpus > 0 {
+			ch <- prometheus.MustNewConstMetric(ac.running_cpus, prometheus.GaugeValue, am[a].running_cpus, a)
+		}
+		if am[a].suspended > 0 {
+			ch <- prometheus.MustNewConstMetric(ac.suspended, prometheus.GaugeValue, am[a].suspended, a)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,246 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+
+	"github.com/prometheus/common/log"
+)
+
+// Returned by a backend for data it can not provide
+var errNotSupported = errors.New("not supported by the backend")
+
+/*
+ * A Backend provides the Slurm data to the collectors. The CLIBackend
+ * executes the Slurm commands, the RESTBackend (see rest.go) queries the
+ * slurmrestd REST API.
+ */
+type Backend interface {
+	CPUs() (*CPUsMetrics, error)
+	GPUs() (*GPUsMetrics, error)
+	Nodes() (*NodesMetrics, error)
+	Partitions() (map[string]*PartitionMetrics, error)
+	Jobs() ([]Job, error)
+	Scheduler() (*SchedulerMetrics, error)
+	FairShare() (map[string]*FairShareMetrics, error)
+	Controllers() ([]ControllerStatus, error)
+	Version() (string, error)
+}
+
+// Returns the backend of the settings for the cluster, empty for the local cluster
+func NewBackend(settings *Settings, cluster string) (Backend, error) {
+	switch settings.Backend {
+	case "cli":
+		return newCLIBackend(settings, cluster, cluster, nil)
+	case "rest":
+		if cluster != "" {
+			return nil, fmt.Errorf("the rest backend can not collect from cluster %s, run an exporter per slurmrestd", cluster)
+		}
+		rest := settings.REST
+		return NewRESTBackend(rest.URL, rest.APIVersion, rest.User, rest.TokenFile, rest.Timeout)
+	}
+	return nil, fmt.Errorf("unknown backend %s", settings.Backend)
+}
+
+/*
+ * Returns the CLI backend of the cluster, the commands are executed with
+ * the variables of env and their metrics are labeled with the name.
+ */
+func newCLIBackend(settings *Settings, name, cluster string, env []string) (*CLIBackend, error) {
+	runner, err := newRunner(settings, name, env)
+	if err != nil {
+		return nil, err
+	}
+	if cluster != "" {
+		runner = NewClusterRunner(runner, cluster) // from cluster.go
+	}
+	backend := NewCLIBackend(runner)
+	backend.settings = settings
+	json, err := JSONCommands(backend.runner, settings.Format) // from json.go
+	if err != nil {
+		log.Warnf("Parsing the text output of the Slurm commands: %s", err)
+	}
+	backend.json = json
+	return backend, nil
+}
+
+// Returns the runner executing or replaying the commands, recording them if selected
+func newRunner(settings *Settings, name string, env []string) (Runner, error) {
+	commands := NewEnvCommandRunner(settings.Commands, env)
+	commands.cluster = name
+	var runner Runner = commands
+	if settings.ReplayDir != "" {
+		replay, err := NewReplayRunner(settings.ReplayDir) // from record.go
+		if err != nil {
+			return nil, err
+		}
+		runner = replay
+	}
+	if settings.RecordDir != "" {
+		return NewRecordingRunner(runner, settings.RecordDir, settings.RecordKeep)
+	}
+	return runner, nil
+}
+
+/*
+ * Parses the output of the Slurm commands executed by the runner, the
+ * commands in json are parsed from their --json output. The settings of
+ * the runner are checked by Check.
+ */
+type CLIBackend struct {
+	runner   Runner
+	json     map[string]bool
+	settings *Settings
+}
+
+func NewCLIBackend(runner Runner) *CLIBackend {
+	return &CLIBackend{runner: runner, json: make(map[string]bool), settings: FlagSettings()}
+}
+
+// Implements the nodesReader interface (see nodes.go) for the --json output of sinfo
+func (b *CLIBackend) readNodes() (*nodesData, error) {
+	if !b.json["sinfo"] {
+		return nil, errNotSupported
+	}
+	data, err := SinfoJSONData(b.runner)
+	if err != nil {
+		return nil, err
+	}
+	nodes, partitions, err := ParseSinfoJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return &nodesData{nodes: nodes, partitions: partitions}, nil
+}
+
+// The GPUs are read from sacct and sinfo, not from the --json output
+func (b *CLIBackend) gpus(data *nodesData) (*GPUsMetrics, error) {
+	return b.GPUs()
+}
+
+func (b *CLIBackend) partitions(data *nodesData) (map[string]*PartitionMetrics, error) {
+	return restPartitionsMetrics(data.partitions, data.nodes), nil
+}
+
+func (b *CLIBackend) CPUs() (*CPUsMetrics, error) {
+	if b.json["sinfo"] {
+		return NewNodesSnapshot(b).CPUs()
+	}
+	return CPUsGetMetrics(b.runner)
+}
+
+func (b *CLIBackend) GPUs() (*GPUsMetrics, error) {
+	return GPUsGetMetrics(b.runner)
+}
+
+func (b *CLIBackend) Nodes() (*NodesMetrics, error) {
+	if b.json["sinfo"] {
+		return NewNodesSnapshot(b).Nodes()
+	}
+	return NodesGetMetrics(b.runner)
+}
+
+func (b *CLIBackend) Partitions() (map[string]*PartitionMetrics, error) {
+	if b.json["sinfo"] {
+		return NewNodesSnapshot(b).Partitions()
+	}
+	data, err := PartitionsData(b.runner)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePartitionsMetrics(data), nil
+}
+
+func (b *CLIBackend) Jobs() ([]Job, error) {
+	if b.json["squeue"] {
+		data, err := SqueueJSONData(b.runner)
+		if err != nil {
+			return nil, err
+		}
+		return ParseJobsJSON(data)
+	}
+	data, err := JobsData(b.runner)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJobs(data), nil
+}
+
+func (b *CLIBackend) Scheduler() (*SchedulerMetrics, error) {
+	if b.json["sdiag"] {
+		data, err := SdiagJSONData(b.runner)
+		if err != nil {
+			return nil, err
+		}
+		return ParseSchedulerJSON(data)
+	}
+	return SchedulerGetMetrics(b.runner)
+}
+
+func (b *CLIBackend) FairShare() (map[string]*FairShareMetrics, error) {
+	return ParseFairShareMetrics(b.runner)
+}
+
+func (b *CLIBackend) Controllers() ([]ControllerStatus, error) {
+	data, err := ControllerData(b.runner)
+	if err != nil {
+		return nil, err
+	}
+	return ParseControllerStatus(data), nil
+}
+
+// Starts a new scrape of the runner, see RecordingRunner
+func (b *CLIBackend) Reset() {
+	if r, ok := b.runner.(resetter); ok {
+		r.Reset()
+	}
+}
+
+// Returns an error if a Slurm command is not installed, unless the commands are replayed
+func (b *CLIBackend) Check() error {
+	if b.settings.ReplayDir != "" {
+		return nil
+	}
+	// The commands may not be installed locally, e.g. if executed with ssh
+	if prefix := b.settings.Commands.Prefix; len(prefix) > 0 {
+		_, err := exec.LookPath(prefix[0])
+		return err
+	}
+	commands := make([]string, 0, len(slurmCommands))
+	for command := range slurmCommands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		if _, err := exec.LookPath(b.settings.Commands.CommandPath(command)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *CLIBackend) Version() (string, error) {
+	data, err := SlurmVersionData(b.runner)
+	if err != nil {
+		return "", err
+	}
+	version, _, _, err := ParseSlurmVersion(data)
+	return version, err
+}
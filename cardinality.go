@@ -0,0 +1,197 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var seriesDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "slurm_exporter_series_dropped_total",
+	Help: "Number of series of users and accounts not exported because of the cardinality limits",
+}, []string{"collector"})
+
+// The users and accounts not kept are aggregated with this name
+const otherBucket = "other"
+
+/*
+ * A CardinalityLimit selects the users or accounts with a series of
+ * their own. A name is kept if it matches one of the allow regexes, if
+ * any, and none of the deny regexes, both anchored like the label
+ * filters. With top_n only the names with the most running CPUs, then
+ * the most jobs, are kept. All other names are dropped or, with other,
+ * aggregated in the series of the name "other".
+ */
+type CardinalityLimit struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	TopN  int      `yaml:"top_n"`
+	Other bool     `yaml:"other"`
+
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func compileAnchored(exprs []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+func matchAny(regexps []*regexp.Regexp, value string) bool {
+	for _, re := range regexps {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cl *CardinalityLimit) compile() error {
+	if cl.TopN < 0 {
+		return fmt.Errorf("negative top_n %d", cl.TopN)
+	}
+	var err error
+	if cl.allow, err = compileAnchored(cl.Allow); err != nil {
+		return fmt.Errorf("allow: %s", err)
+	}
+	if cl.deny, err = compileAnchored(cl.Deny); err != nil {
+		return fmt.Errorf("deny: %s", err)
+	}
+	return nil
+}
+
+func (cl *CardinalityLimit) allowed(name string) bool {
+	if len(cl.allow) > 0 && !matchAny(cl.allow, name) {
+		return false
+	}
+	return !matchAny(cl.deny, name)
+}
+
+// Number of series exported for the metrics, series of zero values are not exported
+func (jm *JobMetrics) series() int {
+	n := 0
+	for _, v := range []float64{jm.pending, jm.running, jm.running_cpus, jm.suspended} {
+		if v > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (jm *JobMetrics) add(other *JobMetrics) {
+	jm.pending += other.pending
+	jm.running += other.running
+	jm.running_cpus += other.running_cpus
+	jm.suspended += other.suspended
+}
+
+/*
+ * Returns the metrics of the names kept by the limit and the number of
+ * series dropped. The metrics passed in are not modified.
+ */
+func (cl *CardinalityLimit) Apply(metrics map[string]*JobMetrics) (map[string]*JobMetrics, int) {
+	if cl == nil {
+		return metrics, 0
+	}
+	names := []string{}
+	for name := range metrics {
+		if cl.allowed(name) {
+			names = append(names, name)
+		}
+	}
+	if cl.TopN > 0 && len(names) > cl.TopN {
+		sort.Slice(names, func(i, j int) bool {
+			a, b := metrics[names[i]], metrics[names[j]]
+			if a.running_cpus != b.running_cpus {
+				return a.running_cpus > b.running_cpus
+			}
+			if jobsA, jobsB := a.pending+a.running+a.suspended, b.pending+b.running+b.suspended; jobsA != jobsB {
+				return jobsA > jobsB
+			}
+			return names[i] < names[j]
+		})
+		names = names[:cl.TopN]
+	}
+	kept := make(map[string]*JobMetrics)
+	for _, name := range names {
+		kept[name] = metrics[name]
+	}
+	dropped := 0
+	other := &JobMetrics{}
+	for name, m := range metrics {
+		if _, ok := kept[name]; !ok {
+			dropped += m.series()
+			other.add(m)
+		}
+	}
+	if cl.Other && dropped > 0 {
+		// A name kept as "other" is aggregated with the dropped names
+		if m, ok := kept[otherBucket]; ok {
+			other.add(m)
+		}
+		kept[otherBucket] = other
+	}
+	return kept, dropped
+}
+
+// Whether Apply aggregated the dropped names in the series of the name "other"
+func (cl *CardinalityLimit) Aggregated(dropped int) bool {
+	return cl != nil && cl.Other && dropped > 0
+}
+
+/*
+ * A series of the names aggregated by a cardinality limit. Its label is
+ * not a user name, so it is not replaced by a pseudonym, unlike the
+ * series of a real user named "other".
+ */
+type otherMetric struct {
+	prometheus.Metric
+}
+
+// The cardinality limits indexed by the collector name
+type CardinalityLimits map[string]*CardinalityLimit
+
+// Implemented by the collectors of series per user or account
+type limiter interface {
+	SetCardinalityLimit(limit *CardinalityLimit)
+}
+
+// Compile the regexes of all limits
+func (cl CardinalityLimits) Compile() error {
+	for collector, limit := range cl {
+		if collector != "users" && collector != "accounts" {
+			return fmt.Errorf("collector %s: only the users and accounts collectors are limited", collector)
+		}
+		if limit == nil {
+			return fmt.Errorf("collector %s: empty limit", collector)
+		}
+		if err := limit.compile(); err != nil {
+			return fmt.Errorf("collector %s: %s", collector, err)
+		}
+	}
+	return nil
+}
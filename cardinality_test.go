@@ -0,0 +1,119 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testJobMetrics() map[string]*JobMetrics {
+	return map[string]*JobMetrics{
+		"alice": {pending: 1, running: 4, running_cpus: 4},
+		"bob":   {pending: 2, running: 2, running_cpus: 8},
+		"carol": {running: 1, running_cpus: 8, suspended: 1},
+		"root":  {running: 1, running_cpus: 64},
+		"dave":  {pending: 3},
+	}
+}
+
+func TestCardinalityLimit(t *testing.T) {
+	for name, tc := range map[string]struct {
+		limit   *CardinalityLimit
+		kept    []string
+		dropped int
+	}{
+		"none":  {nil, []string{"alice", "bob", "carol", "dave", "root"}, 0},
+		"allow": {&CardinalityLimit{Allow: []string{"a.*", "b.*"}}, []string{"alice", "bob"}, 6},
+		"deny":  {&CardinalityLimit{Deny: []string{"root"}}, []string{"alice", "bob", "carol", "dave"}, 2},
+		// Ranked by running CPUs, then by the number of jobs
+		"top":       {&CardinalityLimit{Deny: []string{"root"}, TopN: 2}, []string{"bob", "carol"}, 6},
+		"top other": {&CardinalityLimit{TopN: 3, Other: true}, []string{"bob", "carol", "other", "root"}, 4},
+	} {
+		limit := tc.limit
+		if limit != nil {
+			if err := (CardinalityLimits{"users": limit}).Compile(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		kept, dropped := limit.Apply(testJobMetrics())
+		names := []string{}
+		for name := range kept {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tc.kept) || dropped != tc.dropped {
+			t.Errorf("%s: expected %v and %d dropped series, got %v and %d", name, tc.kept, tc.dropped, names, dropped)
+		}
+	}
+}
+
+func TestCardinalityLimitOther(t *testing.T) {
+	limit := &CardinalityLimit{Allow: []string{"root", "other"}, Other: true}
+	if err := limit.compile(); err != nil {
+		t.Fatal(err)
+	}
+	metrics := testJobMetrics()
+	metrics["other"] = &JobMetrics{running: 1, running_cpus: 1}
+	kept, _ := limit.Apply(metrics)
+	// The name "other" is aggregated with the dropped names
+	if *kept["other"] != (JobMetrics{pending: 6, running: 8, running_cpus: 21, suspended: 1}) {
+		t.Errorf("Unexpected other bucket %+v", kept["other"])
+	}
+	if *metrics["other"] != (JobMetrics{running: 1, running_cpus: 1}) {
+		t.Errorf("The metrics passed in were modified: %+v", metrics["other"])
+	}
+}
+
+func TestInvalidCardinalityLimits(t *testing.T) {
+	for _, limits := range []CardinalityLimits{
+		{"nodes": {TopN: 10}},
+		{"users": {Allow: []string{"("}}},
+		{"accounts": {TopN: -1}},
+		{"users": nil},
+	} {
+		if err := limits.Compile(); err == nil {
+			t.Errorf("Expected an error for %v", limits)
+		}
+	}
+}
+
+func TestUsersCollectorCardinality(t *testing.T) {
+	runner := testRunner{"squeue -a -r -h -o %A|%a|%u|%T|%C|%P|%r --states=all": "test_data/squeue.txt"}
+	collector := NewSlurmCollector(map[string]Collector{"users": NewUsersCollector(NewJobsSnapshot(NewCLIBackend(runner)))})
+	limits := CardinalityLimits{"users": {TopN: 1, Other: true}}
+	if err := limits.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	collector.SetCardinalityLimits(limits)
+	before := testutil.ToFloat64(seriesDroppedTotal.WithLabelValues("users"))
+	expected := `
+# HELP slurm_user_cpus_running Running cpus for user
+# TYPE slurm_user_cpus_running gauge
+slurm_user_cpus_running{user="dave"} 112
+slurm_user_cpus_running{user="other"} 88
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_user_cpus_running"); err != nil {
+		t.Error(err)
+	}
+	if dropped := testutil.ToFloat64(seriesDroppedTotal.WithLabelValues("users")) - before; dropped != 10 {
+		t.Errorf("Expected 10 dropped series, got %v", dropped)
+	}
+}
@@ -0,0 +1,87 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Returns the clusters of a comma separated list, see -cluster
+func parseClusters(names string) []string {
+	clusters := []string{}
+	for _, cluster := range strings.Split(names, ",") {
+		if cluster = strings.TrimSpace(cluster); cluster != "" {
+			clusters = append(clusters, cluster)
+		}
+	}
+	return clusters
+}
+
+// Adds the cluster label to all metrics registered, unless it is the local cluster
+func ClusterRegisterer(registerer prometheus.Registerer, cluster string) prometheus.Registerer {
+	if cluster == "" {
+		return registerer
+	}
+	return prometheus.WrapRegistererWith(prometheus.Labels{"cluster": cluster}, registerer)
+}
+
+// Commands accepting the cluster with -M
+var clusterCommands = map[string]bool{
+	"sacct":    true,
+	"scontrol": true,
+	"sdiag":    true,
+	"sinfo":    true,
+	"squeue":   true,
+	"sshare":   true,
+}
+
+// Printed before the output of a command executed with -M
+var clusterHeader = regexp.MustCompile(`(?m)^CLUSTER: .*\n?`)
+
+/*
+ * The ClusterRunner executes the Slurm commands for another cluster of the
+ * federation served by the same slurmdbd, by passing -M to every command
+ * supporting it.
+ */
+type ClusterRunner struct {
+	runner  Runner
+	cluster string
+}
+
+func NewClusterRunner(runner Runner, cluster string) *ClusterRunner {
+	return &ClusterRunner{runner: runner, cluster: cluster}
+}
+
+func (cr *ClusterRunner) Run(command string, args ...string) ([]byte, error) {
+	if !clusterCommands[command] {
+		return cr.runner.Run(command, args...)
+	}
+	out, err := cr.runner.Run(command, append([]string{"-M", cr.cluster}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	return clusterHeader.ReplaceAll(out, nil), nil
+}
+
+// Starts a new scrape of the runner, see RecordingRunner
+func (cr *ClusterRunner) Reset() {
+	if r, ok := cr.runner.(resetter); ok {
+		r.Reset()
+	}
+}
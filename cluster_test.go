@@ -0,0 +1,46 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClusterRunner(t *testing.T) {
+	runner := testRunner{
+		"sinfo -M alpha -h -o %C": "test_data/sinfo_cpus_cluster.txt",
+		"sinfo -M beta -h -o %C":  "test_data/sinfo_cpus.txt",
+	}
+	registry := prometheus.NewRegistry()
+	for _, cluster := range []string{"alpha", "beta"} {
+		backend := NewCLIBackend(NewClusterRunner(runner, cluster))
+		collector := NewSlurmCollector(map[string]Collector{"cpus": NewCPUsCollector(NewNodesSnapshot(backend))})
+		ClusterRegisterer(registry, cluster).MustRegister(collector)
+	}
+	expected := `
+# HELP slurm_cpus_total Total CPUs
+# TYPE slurm_cpus_total gauge
+slurm_cpus_total{cluster="alpha"} 6636
+slurm_cpus_total{cluster="beta"} 6636
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "slurm_cpus_total"); err != nil {
+		t.Error(err)
+	}
+}
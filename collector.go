@@ -0,0 +1,398 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+/*
+ * Every Slurm collector implements the Collector interface. Update sends
+ * the metrics to the channel and returns an error if the data could not
+ * be gathered, for example because a Slurm command failed. In this case
+ * nothing must have been sent to the channel.
+ */
+type Collector interface {
+	Describe(ch chan<- *prometheus.Desc)
+	Update(ch chan<- prometheus.Metric) error
+}
+
+// Implemented by collectors sharing data with other collectors
+type resetter interface {
+	Reset()
+}
+
+/*
+ * Constructors of all Slurm collectors, indexed by the collector name. The
+ * collectors based on squeue share a single snapshot of the jobs, those
+ * based on the nodes a single snapshot of the nodes.
+ */
+var collectorFactories = map[string]func(Backend, *NodesSnapshot, *JobsSnapshot) Collector{
+	"accounts":   func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewAccountsCollector(j) },      // from accounts.go
+	"controller": func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewControllerCollector(b) },    // from controller.go
+	"cpus":       func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewCPUsCollector(n) },          // from cpus.go
+	"gpus":       func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewGPUsCollector(n) },          // from gpus.go
+	"nodes":      func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewNodesCollector(n) },         // from nodes.go
+	"partitions": func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewPartitionsCollector(n, j) }, // from partitions.go
+	"queue":      func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewQueueCollector(j) },         // from queue.go
+	"scheduler":  func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewSchedulerCollector(b) },     // from scheduler.go
+	"fairshare":  func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewFairShareCollector(b) },     // from sshare.go
+	"users":      func(b Backend, n *NodesSnapshot, j *JobsSnapshot) Collector { return NewUsersCollector(j) },         // from users.go
+}
+
+// Returns the named collectors, all reading their data from the backend
+func NewCollectors(names []string, backend Backend) (map[string]Collector, error) {
+	collectors := make(map[string]Collector)
+	nodes := NewNodesSnapshot(backend)
+	jobs := NewJobsSnapshot(backend)
+	for _, name := range names {
+		factory, ok := collectorFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector %s", name)
+		}
+		collectors[name] = factory(backend, nodes, jobs)
+	}
+	return collectors, nil
+}
+
+/*
+ * The metrics and the outcome of a single update of a collector. The
+ * metrics of a failed update are those of the last successful update, if
+ * kept, and dataTime is the time of that update.
+ */
+type collectorResult struct {
+	metrics  []prometheus.Metric
+	err      error
+	duration time.Duration
+	time     time.Time
+	dataTime time.Time
+}
+
+// Returns the metrics to send, none once the metrics of a failed update are older than the maximum age
+func (r *collectorResult) current(maxAge time.Duration) ([]prometheus.Metric, bool) {
+	if r.dataTime.IsZero() {
+		return nil, false
+	}
+	if r.err != nil && time.Since(r.dataTime) > maxAge {
+		return nil, false
+	}
+	return r.metrics, true
+}
+
+/*
+ * The SlurmCollector implements the Prometheus Collector interface and
+ * dispatches to the Slurm collectors, which are updated concurrently. A
+ * failing collector is reported by the exporter metrics and does not
+ * affect the other collectors.
+ *
+ * By default the collectors are updated on every scrape, concurrent
+ * scrapes share a single update. Once polling is started the collectors
+ * are updated in the background instead, and the results of the last
+ * update are sent on every scrape.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+type SlurmCollector struct {
+	collectors  map[string]Collector
+	enabled     *prometheus.Desc
+	duration    *prometheus.Desc
+	success     *prometheus.Desc
+	lastRefresh *prometheus.Desc
+	dataAge     *prometheus.Desc
+	errors      *prometheus.CounterVec
+
+	mu            sync.RWMutex
+	polling       bool
+	stop          chan struct{}
+	minInterval   time.Duration
+	maxAges       map[string]time.Duration
+	refreshing    chan struct{}
+	refreshed     time.Time
+	filters       LabelFilters
+	pseudonymizer *Pseudonymizer
+	backend       Backend
+	results       map[string]*collectorResult
+}
+
+func NewSlurmCollector(collectors map[string]Collector) *SlurmCollector {
+	errors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slurm_exporter_collector_errors_total",
+		Help: "Number of failed updates of a collector",
+	}, []string{"collector"})
+	// Export the counter for every collector, even before the first error
+	for name := range collectors {
+		errors.WithLabelValues(name)
+	}
+	return &SlurmCollector{
+		collectors: collectors,
+		enabled: prometheus.NewDesc(
+			"slurm_exporter_collector_enabled",
+			"Whether a collector is enabled",
+			[]string{"collector"},
+			nil),
+		duration: prometheus.NewDesc(
+			"slurm_exporter_collector_duration_seconds",
+			"Duration of the last update of a collector",
+			[]string{"collector"},
+			nil),
+		success: prometheus.NewDesc(
+			"slurm_exporter_collector_success",
+			"Whether the last update of a collector succeeded",
+			[]string{"collector"},
+			nil),
+		lastRefresh: prometheus.NewDesc(
+			"slurm_exporter_last_refresh_timestamp_seconds",
+			"Unix timestamp of the last update of a collector",
+			[]string{"collector"},
+			nil),
+		dataAge: prometheus.NewDesc(
+			"slurm_exporter_collector_data_age_seconds",
+			"Age of the metrics of a collector, of the last successful update if the last update failed",
+			[]string{"collector"},
+			nil),
+		errors:  errors,
+		results: make(map[string]*collectorResult),
+	}
+}
+
+// Send all metric descriptions
+func (sc *SlurmCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range sc.collectors {
+		c.Describe(ch)
+	}
+	ch <- sc.enabled
+	ch <- sc.duration
+	ch <- sc.success
+	ch <- sc.lastRefresh
+	ch <- sc.dataAge
+	sc.errors.Describe(ch)
+}
+
+// Send the values of all metrics, updating the collectors unless polling
+func (sc *SlurmCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.mu.RLock()
+	polling := sc.polling
+	sc.mu.RUnlock()
+	if !polling {
+		sc.Refresh()
+	}
+	sc.mu.RLock()
+	for name, result := range sc.results {
+		if metrics, ok := result.current(sc.maxAges[name]); ok {
+			for _, m := range metrics {
+				ch <- m
+			}
+			ch <- prometheus.MustNewConstMetric(sc.dataAge, prometheus.GaugeValue, time.Since(result.dataTime).Seconds(), name)
+		}
+		success := 1.0
+		if result.err != nil {
+			success = 0
+		}
+		ch <- prometheus.MustNewConstMetric(sc.duration, prometheus.GaugeValue, result.duration.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(sc.success, prometheus.GaugeValue, success, name)
+		ch <- prometheus.MustNewConstMetric(sc.lastRefresh, prometheus.GaugeValue, float64(result.time.UnixNano())/1e9, name)
+	}
+	sc.mu.RUnlock()
+	for name := range collectorFactories {
+		enabled := 0.0
+		if _, ok := sc.collectors[name]; ok {
+			enabled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(sc.enabled, prometheus.GaugeValue, enabled, name)
+	}
+	sc.errors.Collect(ch)
+}
+
+/*
+ * Update all collectors in parallel and keep their results. Concurrent
+ * calls wait for the update in progress instead of executing the Slurm
+ * commands again, and within the minimum interval after the start of the
+ * last update the results of the last update are kept.
+ */
+func (sc *SlurmCollector) Refresh() {
+	sc.mu.Lock()
+	if done := sc.refreshing; done != nil {
+		sc.mu.Unlock()
+		<-done
+		return
+	}
+	if sc.minInterval > 0 && time.Since(sc.refreshed) < sc.minInterval {
+		sc.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	sc.refreshing = done
+	sc.refreshed = time.Now()
+	sc.mu.Unlock()
+	sc.refresh()
+	sc.mu.Lock()
+	sc.refreshing = nil
+	sc.mu.Unlock()
+	close(done)
+}
+
+func (sc *SlurmCollector) refresh() {
+	// Data shared between collectors is only valid for a single update
+	if r, ok := sc.backend.(resetter); ok {
+		r.Reset()
+	}
+	for _, c := range sc.collectors {
+		if r, ok := c.(resetter); ok {
+			r.Reset()
+		}
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(len(sc.collectors))
+	for name, c := range sc.collectors {
+		go func(name string, c Collector) {
+			defer wg.Done()
+			result := sc.update(name, c)
+			sc.mu.Lock()
+			// Keep the metrics of the last successful update of a failed collector
+			if last, ok := sc.results[name]; ok && result.err != nil && sc.maxAges[name] > 0 {
+				if metrics, ok := last.current(sc.maxAges[name]); ok {
+					result.metrics, result.dataTime = metrics, last.dataTime
+				}
+			}
+			sc.results[name] = result
+			sc.mu.Unlock()
+		}(name, c)
+	}
+	wg.Wait()
+}
+
+/*
+ * Update the collectors in the background every interval, scrapes are
+ * served from the results of the last update from now on. The first
+ * update starts right away, unless the collectors were already updated.
+ */
+func (sc *SlurmCollector) StartPolling(interval time.Duration) {
+	sc.mu.Lock()
+	sc.polling = true
+	sc.stop = make(chan struct{})
+	stop := sc.stop
+	updated := !sc.refreshed.IsZero()
+	sc.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		if !updated {
+			sc.Refresh()
+		}
+		for {
+			select {
+			case <-ticker.C:
+				sc.Refresh()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop updating the collectors in the background, e.g. once replaced on reload
+func (sc *SlurmCollector) StopPolling() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.stop != nil {
+		close(sc.stop)
+		sc.stop = nil
+	}
+}
+
+/*
+ * Set the backend of the collectors, it is reset before every update like
+ * the collectors, e.g. to save the recordings of every update into a
+ * directory of its own.
+ */
+func (sc *SlurmCollector) SetBackend(backend Backend) {
+	sc.backend = backend
+}
+
+// Keep the results of an update for at least the interval, 0 updates the collectors on every scrape
+func (sc *SlurmCollector) SetMinInterval(interval time.Duration) {
+	sc.mu.Lock()
+	sc.minInterval = interval
+	sc.mu.Unlock()
+}
+
+// Serve the metrics of the last successful update of a failed collector for up to its maximum age
+func (sc *SlurmCollector) SetMaxAges(maxAges map[string]time.Duration) {
+	sc.mu.Lock()
+	sc.maxAges = maxAges
+	sc.mu.Unlock()
+}
+
+// Drop the series of all collectors filtered by the value of a label (see filter.go)
+func (sc *SlurmCollector) SetLabelFilters(filters LabelFilters) {
+	sc.mu.Lock()
+	sc.filters = filters
+	sc.mu.Unlock()
+}
+
+// Replace the user names of all collectors by pseudonyms (see pseudonym.go), nil exports the names
+func (sc *SlurmCollector) SetPseudonymizer(p *Pseudonymizer) {
+	sc.mu.Lock()
+	sc.pseudonymizer = p
+	sc.mu.Unlock()
+}
+
+// Limit the series of the users and accounts collectors (see cardinality.go), before polling is started
+func (sc *SlurmCollector) SetCardinalityLimits(limits CardinalityLimits) {
+	for name, c := range sc.collectors {
+		if l, ok := c.(limiter); ok {
+			l.SetCardinalityLimit(limits[name])
+		}
+	}
+}
+
+// Update a single collector and record its metrics, duration and success
+func (sc *SlurmCollector) update(name string, c Collector) *collectorResult {
+	sc.mu.RLock()
+	filters := sc.filters
+	pseudonymizer := sc.pseudonymizer
+	sc.mu.RUnlock()
+	result := &collectorResult{time: time.Now()}
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			// The filters select by the user names
+			if filters.Keep(m) {
+				result.metrics = append(result.metrics, pseudonymizer.Metric(m))
+			}
+		}
+		close(done)
+	}()
+	result.err = c.Update(ch)
+	close(ch)
+	<-done
+	result.duration = time.Since(result.time)
+	if result.err != nil {
+		log.Errorf("Collector %s failed after %s: %s", name, result.duration, result.err)
+		sc.errors.WithLabelValues(name).Inc()
+		// Never send metrics of a failed update
+		result.metrics = nil
+	} else {
+		log.Debugf("Collector %s succeeded after %s", name, result.duration)
+		result.dataTime = result.time
+	}
+	return result
+}
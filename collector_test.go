@@ -0,0 +1,251 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type testCollector struct {
+	desc    *prometheus.Desc
+	metrics []prometheus.Metric
+	err     error
+	delay   time.Duration
+	updates int32
+}
+
+func (tc *testCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.desc
+}
+
+func (tc *testCollector) Update(ch chan<- prometheus.Metric) error {
+	atomic.AddInt32(&tc.updates, 1)
+	time.Sleep(tc.delay)
+	if tc.err != nil {
+		return tc.err
+	}
+	if tc.metrics != nil {
+		for _, m := range tc.metrics {
+			ch <- m
+		}
+		return nil
+	}
+	ch <- prometheus.MustNewConstMetric(tc.desc, prometheus.GaugeValue, 1)
+	return nil
+}
+
+// Gather the metrics of the collector, indexed by name and collector label
+func gatherByCollector(t *testing.T, c prometheus.Collector) map[string]map[string]*dto.Metric {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Can not gather metrics: %v", err)
+	}
+	result := make(map[string]map[string]*dto.Metric)
+	for _, family := range families {
+		result[family.GetName()] = make(map[string]*dto.Metric)
+		for _, m := range family.GetMetric() {
+			name := ""
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "collector" {
+					name = l.GetValue()
+				}
+			}
+			result[family.GetName()][name] = m
+		}
+	}
+	return result
+}
+
+func TestSlurmCollectorFailure(t *testing.T) {
+	sc := NewSlurmCollector(map[string]Collector{
+		"good": &testCollector{desc: prometheus.NewDesc("test_good", "Good collector", nil, nil)},
+		"bad":  &testCollector{desc: prometheus.NewDesc("test_bad", "Bad collector", nil, nil), err: errors.New("exit status 1")},
+	})
+	metrics := gatherByCollector(t, sc)
+	if _, ok := metrics["test_good"]; !ok {
+		t.Errorf("Metrics of the good collector are missing")
+	}
+	if _, ok := metrics["test_bad"]; ok {
+		t.Errorf("Metrics of the bad collector are exported")
+	}
+	if v := metrics["slurm_exporter_collector_success"]["good"].GetGauge().GetValue(); v != 1 {
+		t.Errorf("Expected success 1 for good collector, got %v", v)
+	}
+	if v := metrics["slurm_exporter_collector_success"]["bad"].GetGauge().GetValue(); v != 0 {
+		t.Errorf("Expected success 0 for bad collector, got %v", v)
+	}
+	if v := metrics["slurm_exporter_collector_errors_total"]["good"].GetCounter().GetValue(); v != 0 {
+		t.Errorf("Expected 0 errors for good collector, got %v", v)
+	}
+	if v := metrics["slurm_exporter_collector_errors_total"]["bad"].GetCounter().GetValue(); v != 1 {
+		t.Errorf("Expected 1 error for bad collector, got %v", v)
+	}
+}
+
+func TestEnabledCollectors(t *testing.T) {
+	defer flag.Set("no-collector.gpus", "false")
+	defer flag.Set("collector.users", "true")
+	flag.Set("no-collector.gpus", "true")
+	flag.Set("collector.users", "false")
+	names := FlagSettings().Collectors
+	for _, name := range names {
+		if name == "gpus" || name == "users" {
+			t.Errorf("Collector %s is enabled", name)
+		}
+	}
+	collectors, err := NewCollectors(names, NewCLIBackend(testRunner{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := gatherByCollector(t, NewSlurmCollector(collectors))
+	if v := metrics["slurm_exporter_collector_enabled"]["gpus"].GetGauge().GetValue(); v != 0 {
+		t.Errorf("Expected gpus collector to be disabled, got %v", v)
+	}
+	if v := metrics["slurm_exporter_collector_enabled"]["cpus"].GetGauge().GetValue(); v != 1 {
+		t.Errorf("Expected cpus collector to be enabled, got %v", v)
+	}
+}
+
+func TestSlurmCollectorConcurrency(t *testing.T) {
+	delay := 200 * time.Millisecond
+	sc := NewSlurmCollector(map[string]Collector{
+		"first":  &testCollector{desc: prometheus.NewDesc("test_first", "First collector", nil, nil), delay: delay},
+		"second": &testCollector{desc: prometheus.NewDesc("test_second", "Second collector", nil, nil), delay: delay},
+	})
+	start := time.Now()
+	metrics := gatherByCollector(t, sc)
+	if elapsed := time.Since(start); elapsed >= 2*delay {
+		t.Errorf("Collectors were not updated in parallel, took %s", elapsed)
+	}
+	for _, name := range []string{"first", "second"} {
+		if v := metrics["slurm_exporter_collector_duration_seconds"][name].GetGauge().GetValue(); v < delay.Seconds() {
+			t.Errorf("Expected duration of at least %s for %s, got %v", delay, name, v)
+		}
+	}
+}
+
+func TestSlurmCollectorPolling(t *testing.T) {
+	tc := &testCollector{desc: prometheus.NewDesc("test_polled", "Polled collector", nil, nil)}
+	sc := NewSlurmCollector(map[string]Collector{"polled": tc})
+	sc.StartPolling(time.Hour)
+	for i := 0; atomic.LoadInt32(&tc.updates) == 0 || len(gatherByCollector(t, sc)["test_polled"]) == 0; i++ {
+		if i > 100 {
+			t.Fatalf("Collector was not updated in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	metrics := gatherByCollector(t, sc)
+	if updates := atomic.LoadInt32(&tc.updates); updates != 1 {
+		t.Errorf("Expected 1 update of the collector, got %v", updates)
+	}
+	if v := metrics["slurm_exporter_last_refresh_timestamp_seconds"]["polled"].GetGauge().GetValue(); v <= 0 {
+		t.Errorf("Expected timestamp of the last refresh, got %v", v)
+	}
+}
+
+func TestSlurmCollectorStopPolling(t *testing.T) {
+	tc := &testCollector{desc: prometheus.NewDesc("test_stopped", "Stopped collector", nil, nil)}
+	sc := NewSlurmCollector(map[string]Collector{"stopped": tc})
+	sc.StartPolling(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	sc.StopPolling()
+	// An update in progress may still finish
+	time.Sleep(20 * time.Millisecond)
+	updates := atomic.LoadInt32(&tc.updates)
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&tc.updates); after != updates {
+		t.Errorf("Expected no updates after polling stopped, got %d more", after-updates)
+	}
+}
+
+func TestSlurmCollectorCoalescing(t *testing.T) {
+	tc := &testCollector{desc: prometheus.NewDesc("test_coalesced", "Coalesced collector", nil, nil), delay: 200 * time.Millisecond}
+	sc := NewSlurmCollector(map[string]Collector{"coalesced": tc})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if len(gatherByCollector(t, sc)["test_coalesced"]) != 1 {
+				t.Errorf("Expected the metrics of the shared update")
+			}
+		}()
+	}
+	wg.Wait()
+	if updates := atomic.LoadInt32(&tc.updates); updates != 1 {
+		t.Errorf("Expected concurrent scrapes to share 1 update, got %d", updates)
+	}
+}
+
+func TestSlurmCollectorMinInterval(t *testing.T) {
+	tc := &testCollector{desc: prometheus.NewDesc("test_limited", "Limited collector", nil, nil)}
+	sc := NewSlurmCollector(map[string]Collector{"limited": tc})
+	sc.SetMinInterval(time.Hour)
+	for i := 0; i < 3; i++ {
+		if len(gatherByCollector(t, sc)["test_limited"]) != 1 {
+			t.Errorf("Expected the metrics of the last update")
+		}
+	}
+	if updates := atomic.LoadInt32(&tc.updates); updates != 1 {
+		t.Errorf("Expected 1 update within the minimum interval, got %d", updates)
+	}
+	sc.SetMinInterval(0)
+	gatherByCollector(t, sc)
+	if updates := atomic.LoadInt32(&tc.updates); updates != 2 {
+		t.Errorf("Expected an update on every scrape without minimum interval, got %d", updates)
+	}
+}
+
+func TestSlurmCollectorMaxAge(t *testing.T) {
+	tc := &testCollector{desc: prometheus.NewDesc("test_stale", "Stale collector", nil, nil)}
+	sc := NewSlurmCollector(map[string]Collector{"stale": tc})
+	sc.SetMaxAges(map[string]time.Duration{"stale": 200 * time.Millisecond})
+	if metrics := gatherByCollector(t, sc); len(metrics["test_stale"]) != 1 {
+		t.Fatalf("Expected the metrics of the successful update")
+	}
+
+	// The metrics of the last successful update are kept up to the maximum age
+	tc.err = errors.New("exit status 1")
+	metrics := gatherByCollector(t, sc)
+	if len(metrics["test_stale"]) != 1 {
+		t.Errorf("Expected the metrics of the last successful update")
+	}
+	if v := metrics["slurm_exporter_collector_success"]["stale"].GetGauge().GetValue(); v != 0 {
+		t.Errorf("Expected the failed update to be reported, got success %v", v)
+	}
+	if _, ok := metrics["slurm_exporter_collector_data_age_seconds"]["stale"]; !ok {
+		t.Errorf("Expected the age of the metrics")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	metrics = gatherByCollector(t, sc)
+	if _, ok := metrics["test_stale"]; ok {
+		t.Errorf("Expected the metrics to drop out after the maximum age")
+	}
+	if _, ok := metrics["slurm_exporter_collector_data_age_seconds"]; ok {
+		t.Errorf("Expected the age to drop out after the maximum age")
+	}
+}
@@ -0,0 +1,352 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// The Slurm commands executed by the collectors, each has flags of its own
+var slurmCommands = map[string]bool{
+	"sacct":    true,
+	"scontrol": true,
+	"sdiag":    true,
+	"sinfo":    true,
+	"squeue":   true,
+	"sshare":   true,
+}
+
+var commandTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "slurm_exporter_command_timeouts_total",
+	Help: "Number of Slurm command executions killed because of a timeout",
+}, []string{"cluster", "command"})
+
+var commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "slurm_exporter_command_duration_seconds",
+	Help:    "Duration of the Slurm command executions",
+	Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+}, []string{"cluster", "command"})
+
+var commandExecutionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "slurm_exporter_command_executions_total",
+	Help: "Number of Slurm command executions by their result, either success, error or timeout",
+}, []string{"cluster", "command", "result"})
+
+var commandOutputBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "slurm_exporter_command_output_bytes_total",
+	Help: "Number of bytes printed on standard output by the Slurm commands",
+}, []string{"cluster", "command"})
+
+// The environment variables of a flag, given as comma-separated NAME=value pairs
+type envFlag []string
+
+func (ef *envFlag) String() string {
+	return strings.Join(*ef, ",")
+}
+
+func (ef *envFlag) Set(value string) error {
+	vars := []string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		if i := strings.Index(pair, "="); i <= 0 {
+			return fmt.Errorf("invalid variable %q, expected NAME=value", pair)
+		}
+		vars = append(vars, pair)
+	}
+	*ef = vars
+	return nil
+}
+
+// The settings of the Slurm commands, see Settings
+type CommandSettings struct {
+	Prefix   []string
+	Quote    bool
+	Env      []string
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+	Paths    map[string]string
+	Envs     map[string][]string
+}
+
+// Returns the variables added to the environment of a command
+func (cs *CommandSettings) CommandEnv(command string) []string {
+	env := append([]string{}, cs.Env...)
+	return append(env, cs.Envs[command]...)
+}
+
+/*
+ * Returns the executable and the arguments executing a command, with the
+ * prefix if set, e.g. sudo -u slurm /opt/slurm/bin/sinfo -h. With Quote
+ * the command and its arguments are quoted for the shell executing them
+ * after the prefix, e.g. ssh headnode squeue '-o %A|%a'.
+ */
+func (cs *CommandSettings) CommandLine(command string, args ...string) (string, []string) {
+	line := append([]string{cs.CommandPath(command)}, args...)
+	if cs.Quote && len(cs.Prefix) > 0 {
+		for i, arg := range line {
+			line[i] = shellQuote(arg)
+		}
+	}
+	line = append(append([]string{}, cs.Prefix...), line...)
+	return line[0], line[1:]
+}
+
+// Arguments without characters interpreted by a shell
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Quotes an argument for a POSIX shell, unless it contains no special characters
+func shellQuote(arg string) string {
+	if shellSafe.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// Returns the path of the executable of a command
+func (cs *CommandSettings) CommandPath(command string) string {
+	if path := cs.Paths[command]; path != "" {
+		return path
+	}
+	return command
+}
+
+// Returns the timeout for the execution of a command
+func (cs *CommandSettings) CommandTimeout(command string) time.Duration {
+	if timeout := cs.Timeouts[command]; timeout > 0 {
+		return timeout
+	}
+	return cs.Timeout
+}
+
+// The parent of the contexts of all commands, cancelled on shutdown
+var commandsContext, cancelCommands = context.WithCancel(context.Background())
+
+// Held by every running command, so that the shutdown can wait for them
+var runningCommands sync.RWMutex
+
+/*
+ * Kill all running commands and wait for them to exit, commands executed
+ * afterwards fail right away. Called on shutdown, so that no command
+ * outlives the exporter.
+ */
+func CancelCommands() {
+	cancelCommands()
+	runningCommands.Lock()
+	runningCommands.Unlock()
+}
+
+/*
+ * Returns the context for the execution of a command. A command started
+ * by runCommand is killed once the timeout has expired or the commands
+ * are cancelled.
+ */
+func commandContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(commandsContext)
+	}
+	return context.WithTimeout(commandsContext, timeout)
+}
+
+/*
+ * The Runner executes a Slurm command and returns its standard output. All
+ * collectors execute their commands through a Runner, tests can inject the
+ * output of a command with their own implementation.
+ */
+type Runner interface {
+	Run(command string, args ...string) ([]byte, error)
+}
+
+// Runs the commands on the local host
+type CommandRunner struct {
+	settings *CommandSettings
+	env      []string
+	// Labels the metrics of the commands, empty for the local cluster
+	cluster string
+}
+
+// Runs the commands with the variables of env added to the environment, e.g. SLURM_CONF=/etc/slurm/slurm.conf
+func NewEnvCommandRunner(settings *CommandSettings, env []string) *CommandRunner {
+	return &CommandRunner{settings: settings, env: env}
+}
+
+func (r *CommandRunner) Run(command string, args ...string) ([]byte, error) {
+	out, err := r.RunOutput(command, args...)
+	if err != nil {
+		return nil, err
+	}
+	return out.Stdout, nil
+}
+
+// The complete output of a command executed by the CommandRunner
+type CommandOutput struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Like Run, but returns the output on standard error and the exit code as well
+func (r *CommandRunner) RunOutput(command string, args ...string) (*CommandOutput, error) {
+	runningCommands.RLock()
+	defer runningCommands.RUnlock()
+	ctx, cancel := commandContext(r.settings.CommandTimeout(command))
+	defer cancel()
+	log.Debugf("Executing %s %s", command, strings.Join(args, " "))
+	name, args := r.settings.CommandLine(command, args...)
+	cmd := exec.Command(name, args...)
+	// The variables of the runner, e.g. of a probe target, take precedence
+	if env := append(r.settings.CommandEnv(command), r.env...); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	start := time.Now()
+	stdout, stderr, err := runCommand(ctx, cmd)
+	commandDuration.WithLabelValues(r.cluster, command).Observe(time.Since(start).Seconds())
+	commandOutputBytesTotal.WithLabelValues(r.cluster, command).Add(float64(len(stdout)))
+	out := &CommandOutput{Stdout: stdout, Stderr: stderr}
+	if err != nil {
+		out.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			out.ExitCode = exitErr.ExitCode()
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			commandExecutionsTotal.WithLabelValues(r.cluster, command, "timeout").Inc()
+			commandTimeoutsTotal.WithLabelValues(r.cluster, command).Inc()
+			return out, fmt.Errorf("%s killed after timeout of %s", command, r.settings.CommandTimeout(command))
+		}
+		commandExecutionsTotal.WithLabelValues(r.cluster, command, "error").Inc()
+		if ctx.Err() == context.Canceled {
+			return out, fmt.Errorf("%s killed on shutdown", command)
+		}
+		if len(stderr) > 0 {
+			return out, fmt.Errorf("%s: %s: %s", command, err, strings.TrimSpace(string(stderr)))
+		}
+		return out, fmt.Errorf("%s: %s", command, err)
+	}
+	commandExecutionsTotal.WithLabelValues(r.cluster, command, "success").Inc()
+	return out, nil
+}
+
+/*
+ * Waited for the command to exit on SIGTERM before it is killed, and for
+ * the output of processes which left the process group of a killed command.
+ */
+const commandWaitDelay = time.Second
+
+/*
+ * Runs a command in a process group of its own and returns its output on
+ * standard output and standard error. Once the context is done the whole
+ * group is stopped, so that the children of the command, e.g. sinfo started
+ * by sudo or ssh, do not outlive it and keep the scrape waiting for the
+ * end of their output.
+ */
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, []byte, error) {
+	// Like exec.CommandContext, do not start commands after a timeout or the shutdown
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stdoutReader.Close()
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdoutWriter.Close()
+		return nil, nil, err
+	}
+	defer stderrReader.Close()
+	// With files the output is not copied by exec, Wait returns once the command exited
+	cmd.Stdout, cmd.Stderr = stdoutWriter, stderrWriter
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	read := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { stdout.ReadFrom(stdoutReader); wg.Done() }()
+		go func() { stderr.ReadFrom(stderrReader); wg.Done() }()
+		wg.Wait()
+		close(read)
+	}()
+	waited := make(chan error, 1)
+	go func() { waited <- cmd.Wait() }()
+
+	// The output ends once all processes of the group closed the pipes
+	select {
+	case <-read:
+	case <-ctx.Done():
+		stopProcessGroup(cmd, read)
+		select {
+		case <-read:
+		case <-time.After(commandWaitDelay):
+			stdoutReader.Close()
+			stderrReader.Close()
+			<-read
+		}
+	}
+	select {
+	case err = <-waited:
+	case <-ctx.Done():
+		exited := make(chan struct{})
+		go func() {
+			err = <-waited
+			close(exited)
+		}()
+		stopProcessGroup(cmd, exited)
+		<-exited
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+/*
+ * Terminates the command and all processes started by it, and kills them
+ * unless done within commandWaitDelay. The exporter can not kill a command
+ * started by sudo as another user, sudo forwards SIGTERM to the command
+ * but dies on SIGKILL without forwarding it.
+ */
+func stopProcessGroup(cmd *exec.Cmd, done <-chan struct{}) {
+	signalProcessGroup(cmd, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(commandWaitDelay):
+		signalProcessGroup(cmd, syscall.SIGKILL)
+	}
+}
+
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil && err != syscall.ESRCH {
+		log.Debugf("Can not signal the process group of %s: %s", cmd.Path, err)
+	}
+}
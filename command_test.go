@@ -0,0 +1,346 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Returns the content of a test data file as output of a command line
+type testRunner map[string]string
+
+func (tr testRunner) Run(command string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{command}, args...), " ")
+	file, ok := tr[line]
+	if !ok {
+		return nil, fmt.Errorf("no test data for %s", line)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// Runs the commands with the settings of the flags
+func newFlagCommandRunner() *CommandRunner {
+	return NewEnvCommandRunner(FlagSettings().Commands, nil)
+}
+
+// Runs the commands with a timeout
+func newTimeoutCommandRunner(timeout time.Duration) *CommandRunner {
+	settings := FlagSettings().Commands
+	settings.Timeout = timeout
+	return NewEnvCommandRunner(settings, nil)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	timeouts := testutil.ToFloat64(commandTimeoutsTotal.WithLabelValues("", "sleep"))
+	start := time.Now()
+	if _, err := newTimeoutCommandRunner(100*time.Millisecond).Run("sleep", "10"); err == nil {
+		t.Fatalf("Expected an error for a timed out command")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Command was not killed after the timeout, took %s", elapsed)
+	}
+	if v := testutil.ToFloat64(commandTimeoutsTotal.WithLabelValues("", "sleep")) - timeouts; v != 1 {
+		t.Errorf("Expected 1 timeout for sleep, got %v", v)
+	}
+}
+
+func TestCommandTimeoutChildren(t *testing.T) {
+	start := time.Now()
+	// The shell waits for the sleep holding its standard output
+	out, err := newTimeoutCommandRunner(200*time.Millisecond).RunOutput("sh", "-c", "sleep 10 & echo $!; wait")
+	if err == nil {
+		t.Fatalf("Expected an error for a timed out command")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Command was not killed after the timeout, took %s", elapsed)
+	}
+	assertKilled(t, out.Stdout)
+}
+
+// Writes an executable prefix with the script, returns its path and removes it on cleanup
+func writePrefix(t *testing.T, script string) (string, func()) {
+	dir, err := ioutil.TempDir("", "prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := filepath.Join(dir, "prefix")
+	if err := ioutil.WriteFile(prefix, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return prefix, func() { os.RemoveAll(dir) }
+}
+
+// Executes the command as its child instead of replacing itself with the command, like sudo or ssh
+const forkingPrefix = `"$@"`
+
+/*
+ * Executes the command outside of its process group and only forwards
+ * SIGTERM to it, like sudo executing the command as another user which
+ * the exporter can not kill.
+ */
+const forwardingPrefix = `setsid "$@" &
+child=$!
+trap 'kill -TERM $child' TERM
+wait $child`
+
+// Returns the settings of the commands with a prefix executing the script, the prefix is removed on cleanup
+func prefixSettings(t *testing.T, script string, timeout time.Duration) (*CommandSettings, func()) {
+	prefix, cleanup := writePrefix(t, script)
+	settings := FlagSettings().Commands
+	settings.Prefix = []string{prefix}
+	settings.Timeout = timeout
+	return settings, cleanup
+}
+
+func TestCommandTimeoutPrefix(t *testing.T) {
+	settings, cleanup := prefixSettings(t, forkingPrefix, 200*time.Millisecond)
+	defer cleanup()
+	start := time.Now()
+	// The command is a child of the prefix, it prints its own pid
+	out, err := NewEnvCommandRunner(settings, nil).RunOutput("sh", "-c", "echo $$; exec sleep 10")
+	if err == nil || !strings.Contains(err.Error(), "killed after timeout") {
+		t.Fatalf("Expected the command to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Command was not killed after the timeout, took %s", elapsed)
+	}
+	assertKilled(t, out.Stdout)
+}
+
+// Fails if the process with the pid printed by a command is still running
+func assertKilled(t *testing.T, output []byte) {
+	pid := strings.TrimSpace(string(output))
+	if pid == "" {
+		t.Fatalf("Expected the pid of the child in the output")
+	}
+	// Killed orphans may not be reaped in a container, they remain zombies
+	time.Sleep(100 * time.Millisecond)
+	stat, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+	if err == nil && !strings.Contains(string(stat), ") Z ") {
+		t.Errorf("Child %s of the command is still running", pid)
+	}
+}
+
+func TestEnvCommandRunner(t *testing.T) {
+	out, err := NewEnvCommandRunner(FlagSettings().Commands, []string{"SLURM_CONF=/etc/slurm-beta/slurm.conf"}).Run("sh", "-c", "echo $SLURM_CONF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "/etc/slurm-beta/slurm.conf\n" {
+		t.Errorf("Expected SLURM_CONF in the environment, got %q", out)
+	}
+}
+
+func TestCancelCommands(t *testing.T) {
+	defer func(ctx context.Context, cancel context.CancelFunc) {
+		commandsContext, cancelCommands = ctx, cancel
+	}(commandsContext, cancelCommands)
+	commandsContext, cancelCommands = context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := newFlagCommandRunner().Run("sleep", "10")
+		errs <- err
+	}()
+	// Wait for the command to be started
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	CancelCommands()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Command was not killed, took %s", elapsed)
+	}
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "killed on shutdown") {
+		t.Errorf("Expected the command to be killed on shutdown, got %v", err)
+	}
+	if _, err := newFlagCommandRunner().Run("true"); err == nil {
+		t.Error("Expected commands to fail after the shutdown")
+	}
+}
+
+func TestCommandTimeoutForwardingPrefix(t *testing.T) {
+	settings, cleanup := prefixSettings(t, forwardingPrefix, 200*time.Millisecond)
+	defer cleanup()
+	out, err := NewEnvCommandRunner(settings, nil).RunOutput("sh", "-c", "echo $$; exec sleep 10")
+	if err == nil || !strings.Contains(err.Error(), "killed after timeout") {
+		t.Fatalf("Expected the command to time out, got %v", err)
+	}
+	assertKilled(t, out.Stdout)
+}
+
+func TestCancelCommandsPrefix(t *testing.T) {
+	defer func(ctx context.Context, cancel context.CancelFunc) {
+		commandsContext, cancelCommands = ctx, cancel
+	}(commandsContext, cancelCommands)
+	commandsContext, cancelCommands = context.WithCancel(context.Background())
+	settings, cleanup := prefixSettings(t, forkingPrefix, 0)
+	defer cleanup()
+	type result struct {
+		out *CommandOutput
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		out, err := NewEnvCommandRunner(settings, nil).RunOutput("sh", "-c", "echo $$; exec sleep 10")
+		results <- result{out, err}
+	}()
+	// Wait for the command to be started
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	CancelCommands()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Command was not killed, took %s", elapsed)
+	}
+	r := <-results
+	if r.err == nil || !strings.Contains(r.err.Error(), "killed on shutdown") {
+		t.Fatalf("Expected the command to be killed on shutdown, got %v", r.err)
+	}
+	assertKilled(t, r.out.Stdout)
+}
+
+func TestCommandPrefix(t *testing.T) {
+	defer flag.Set("command.prefix", "")
+	defer flag.Set("command.sinfo.path", "")
+	flag.Set("command.prefix", "sudo -u slurm")
+	flag.Set("command.sinfo.path", "/opt/slurm/bin/sinfo")
+	name, args := FlagSettings().Commands.CommandLine("sinfo", "-h", "-o %C")
+	if line := append([]string{name}, args...); strings.Join(line, "|") != "sudo|-u|slurm|/opt/slurm/bin/sinfo|-h|-o %C" {
+		t.Errorf("Unexpected command line %q", line)
+	}
+
+	flag.Set("command.prefix", "env GREETING=hello")
+	out, err := newFlagCommandRunner().Run("sh", "-c", "echo $GREETING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello\n" {
+		t.Errorf("Expected the command to be executed with the prefix, got %q", out)
+	}
+}
+
+func TestCommandQuote(t *testing.T) {
+	// Joins its arguments for a shell, like ssh
+	prefix, cleanup := writePrefix(t, `exec sh -c "$*"`)
+	defer cleanup()
+	settings := FlagSettings().Commands
+	settings.Prefix = []string{prefix}
+	settings.Quote = true
+	name, args := settings.CommandLine("squeue", "-h", "-o %A|%a|%u", "it's")
+	if line := append([]string{name}, args...); strings.Join(line, " ") != prefix+` squeue -h '-o %A|%a|%u' 'it'\''s'` {
+		t.Errorf("Unexpected command line %q", line)
+	}
+	out, err := NewEnvCommandRunner(settings, nil).Run("printf", "%s\n", "-o %A|%a|%u", "it's", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "-o %A|%a|%u\nit's\n\n" {
+		t.Errorf("Expected the arguments unchanged, got %q", out)
+	}
+	// Without a prefix the arguments are passed as they are
+	settings.Prefix = nil
+	if _, args := settings.CommandLine("squeue", "-o %A|%a"); args[0] != "-o %A|%a" {
+		t.Errorf("Expected the arguments unquoted without prefix, got %q", args)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	defer flag.Set("command.env", "")
+	defer flag.Set("command.sinfo.env", "")
+	if err := flag.Set("command.env", "SLURM_CONF=/etc/slurm/slurm.conf,GREETING=hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("command.sinfo.env", "PATH=/opt/slurm/bin"); err != nil {
+		t.Fatal(err)
+	}
+	if env := FlagSettings().Commands.CommandEnv("sinfo"); strings.Join(env, ",") != "SLURM_CONF=/etc/slurm/slurm.conf,GREETING=hello,PATH=/opt/slurm/bin" {
+		t.Errorf("Unexpected environment of sinfo %v", env)
+	}
+	if env := FlagSettings().Commands.CommandEnv("squeue"); len(env) != 2 {
+		t.Errorf("Unexpected environment of squeue %v", env)
+	}
+	// The variables of the runner take precedence
+	out, err := NewEnvCommandRunner(FlagSettings().Commands, []string{"SLURM_CONF=/etc/slurm-beta/slurm.conf"}).Run("sh", "-c", "echo $GREETING $SLURM_CONF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello /etc/slurm-beta/slurm.conf\n" {
+		t.Errorf("Unexpected environment %q", out)
+	}
+	if err := flag.Set("command.env", "SLURM_CONF"); err == nil {
+		t.Error("Expected an error for a variable without value")
+	}
+}
+
+func TestCommandMetrics(t *testing.T) {
+	success := testutil.ToFloat64(commandExecutionsTotal.WithLabelValues("", "echo", "success"))
+	failure := testutil.ToFloat64(commandExecutionsTotal.WithLabelValues("", "false", "error"))
+	bytes := testutil.ToFloat64(commandOutputBytesTotal.WithLabelValues("", "echo"))
+	count := histogramCount(t, "echo")
+	if _, err := newFlagCommandRunner().Run("echo", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFlagCommandRunner().Run("false"); err == nil {
+		t.Fatalf("Expected an error for a failed command")
+	}
+	if v := testutil.ToFloat64(commandExecutionsTotal.WithLabelValues("", "echo", "success")) - success; v != 1 {
+		t.Errorf("Expected 1 successful execution of echo, got %v", v)
+	}
+	if v := testutil.ToFloat64(commandExecutionsTotal.WithLabelValues("", "false", "error")) - failure; v != 1 {
+		t.Errorf("Expected 1 failed execution of false, got %v", v)
+	}
+	if v := testutil.ToFloat64(commandOutputBytesTotal.WithLabelValues("", "echo")) - bytes; v != 6 {
+		t.Errorf("Expected 6 bytes of output of echo, got %v", v)
+	}
+	if n := histogramCount(t, "echo") - count; n != 1 {
+		t.Errorf("Expected 1 observed duration of echo, got %v", n)
+	}
+}
+
+func TestCommandMetricsCluster(t *testing.T) {
+	local := testutil.ToFloat64(commandExecutionsTotal.WithLabelValues("", "echo", "success"))
+	alpha := testutil.ToFloat64(commandExecutionsTotal.WithLabelValues("alpha", "echo", "success"))
+	runner := newFlagCommandRunner()
+	runner.cluster = "alpha"
+	if _, err := runner.Run("echo", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(commandExecutionsTotal.WithLabelValues("alpha", "echo", "success")) - alpha; v != 1 {
+		t.Errorf("Expected 1 execution of echo for cluster alpha, got %v", v)
+	}
+	if v := testutil.ToFloat64(commandExecutionsTotal.WithLabelValues("", "echo", "success")) - local; v != 0 {
+		t.Errorf("Expected no execution of echo for the local cluster, got %v", v)
+	}
+}
+
+// Returns the number of durations observed for a command
+func histogramCount(t *testing.T, command string) uint64 {
+	m := &dto.Metric{}
+	if err := commandDuration.WithLabelValues("", command).(prometheus.Histogram).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
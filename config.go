@@ -0,0 +1,378 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configFile = flag.String(
+		"config.file",
+		"",
+		"Path of the YAML configuration file.")
+	configCheck = flag.Bool(
+		"config.check",
+		false,
+		"Validate the configuration file and exit.")
+)
+
+/*
+ * The Config is read from the YAML file given with -config.file. Every
+ * setting of the file corresponds to a command line flag, flags given on
+ * the command line take precedence over the file. The label filters, the
+ * cardinality limits, the targets and the modules are only available in
+ * the file.
+ */
+type Config struct {
+	Backend          string                   `yaml:"backend"`
+	Collectors       map[string]bool          `yaml:"collectors"`
+	Commands         CommandsConfig           `yaml:"commands"`
+	Clusters         []string                 `yaml:"clusters"`
+	CacheInterval    *time.Duration           `yaml:"cache_interval"`
+	CacheMinInterval *time.Duration           `yaml:"cache_min_interval"`
+	CacheMaxAge      *time.Duration           `yaml:"cache_max_age"`
+	CacheMaxAges     map[string]time.Duration `yaml:"cache_max_ages"`
+	LabelFilters     LabelFilters             `yaml:"label_filters"`
+	Cardinality      CardinalityLimits        `yaml:"cardinality"`
+	REST             RESTConfig               `yaml:"rest"`
+	Push             PushConfig               `yaml:"push"`
+	Pseudonymize     PseudonymizeConfig       `yaml:"pseudonymize"`
+	Web              WebConfig                `yaml:"web"`
+	// Clusters and collectors selected by the parameters of /probe
+	Targets map[string]TargetConfig `yaml:"targets"`
+	Modules map[string][]string     `yaml:"modules"`
+}
+
+type CommandsConfig struct {
+	Format     string                       `yaml:"format"`
+	Timeout    *time.Duration               `yaml:"timeout"`
+	Timeouts   map[string]time.Duration     `yaml:"timeouts"`
+	Paths      map[string]string            `yaml:"paths"`
+	RecordDir  string                       `yaml:"record_dir"`
+	RecordKeep *int                         `yaml:"record_keep"`
+	ReplayDir  string                       `yaml:"replay_dir"`
+	Prefix     []string                     `yaml:"prefix"`
+	Quote      *bool                        `yaml:"quote"`
+	Env        map[string]string            `yaml:"env"`
+	Envs       map[string]map[string]string `yaml:"envs"`
+}
+
+type RESTConfig struct {
+	URL        string         `yaml:"url"`
+	APIVersion string         `yaml:"api_version"`
+	User       string         `yaml:"user"`
+	TokenFile  string         `yaml:"token_file"`
+	Timeout    *time.Duration `yaml:"timeout"`
+}
+
+/*
+ * A target of /probe, either collected with the Slurm commands, executed
+ * with -M cluster or with the SLURM_CONF of the cluster, or from the REST
+ * API. Settings of the REST API not given default to the flags.
+ */
+type TargetConfig struct {
+	Backend   string     `yaml:"backend"`
+	Cluster   string     `yaml:"cluster"`
+	SlurmConf string     `yaml:"slurm_conf"`
+	REST      RESTConfig `yaml:"rest"`
+}
+
+type PushConfig struct {
+	URL      string            `yaml:"url"`
+	Interval *time.Duration    `yaml:"interval"`
+	Job      string            `yaml:"job"`
+	Grouping map[string]string `yaml:"grouping"`
+}
+
+type PseudonymizeConfig struct {
+	KeyFile         string `yaml:"key_file"`
+	MappingAuthFile string `yaml:"mapping_auth_file"`
+}
+
+type WebConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+	ConfigFile    string `yaml:"config_file"`
+}
+
+// Read and validate the configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	switch c.Backend {
+	case "", "cli", "rest":
+	default:
+		return fmt.Errorf("backend: unknown backend %s, either cli or rest", c.Backend)
+	}
+	if c.Backend == "rest" && c.REST.URL == "" {
+		return fmt.Errorf("rest: url is required by the rest backend")
+	}
+	for name := range c.Collectors {
+		if _, ok := collectorFactories[name]; !ok {
+			return fmt.Errorf("collectors: unknown collector %s", name)
+		}
+	}
+	switch c.Commands.Format {
+	case "", "auto", "json", "text":
+	default:
+		return fmt.Errorf("commands: unknown format %s, either auto, json or text", c.Commands.Format)
+	}
+	if c.Commands.Timeout != nil && *c.Commands.Timeout < 0 {
+		return fmt.Errorf("commands: negative timeout %s", *c.Commands.Timeout)
+	}
+	for command, timeout := range c.Commands.Timeouts {
+		if !slurmCommands[command] {
+			return fmt.Errorf("commands: timeouts: unknown command %s", command)
+		}
+		if timeout < 0 {
+			return fmt.Errorf("commands: timeouts: negative timeout %s for %s", timeout, command)
+		}
+	}
+	for command := range c.Commands.Paths {
+		if !slurmCommands[command] {
+			return fmt.Errorf("commands: paths: unknown command %s", command)
+		}
+	}
+	for _, arg := range c.Commands.Prefix {
+		if len(strings.Fields(arg)) != 1 {
+			return fmt.Errorf("commands: prefix: invalid argument %q, arguments with white space are not supported", arg)
+		}
+	}
+	if err := validateEnv(c.Commands.Env); err != nil {
+		return fmt.Errorf("commands: env: %s", err)
+	}
+	if c.Commands.RecordKeep != nil && *c.Commands.RecordKeep < 0 {
+		return fmt.Errorf("commands: negative record_keep %d", *c.Commands.RecordKeep)
+	}
+	for command, env := range c.Commands.Envs {
+		if !slurmCommands[command] {
+			return fmt.Errorf("commands: envs: unknown command %s", command)
+		}
+		if err := validateEnv(env); err != nil {
+			return fmt.Errorf("commands: envs: %s: %s", command, err)
+		}
+	}
+	for _, cluster := range c.Clusters {
+		if cluster == "" || strings.Contains(cluster, ",") {
+			return fmt.Errorf("clusters: invalid cluster name %q", cluster)
+		}
+	}
+	if c.CacheInterval != nil && *c.CacheInterval < 0 {
+		return fmt.Errorf("cache_interval: negative interval %s", *c.CacheInterval)
+	}
+	if c.CacheMinInterval != nil && *c.CacheMinInterval < 0 {
+		return fmt.Errorf("cache_min_interval: negative interval %s", *c.CacheMinInterval)
+	}
+	if c.CacheMaxAge != nil && *c.CacheMaxAge < 0 {
+		return fmt.Errorf("cache_max_age: negative age %s", *c.CacheMaxAge)
+	}
+	for name, maxAge := range c.CacheMaxAges {
+		if _, ok := collectorFactories[name]; !ok {
+			return fmt.Errorf("cache_max_ages: unknown collector %s", name)
+		}
+		if maxAge < 0 {
+			return fmt.Errorf("cache_max_ages: negative age %s for %s", maxAge, name)
+		}
+	}
+	if c.Push.Interval != nil && *c.Push.Interval <= 0 {
+		return fmt.Errorf("push: interval must be positive, got %s", *c.Push.Interval)
+	}
+	if _, err := ParseGrouping(c.Push.grouping()); err != nil {
+		return fmt.Errorf("push: grouping: %s", err)
+	}
+	for name, target := range c.Targets {
+		if err := target.validate(); err != nil {
+			return fmt.Errorf("targets: %s: %s", name, err)
+		}
+	}
+	for name, collectors := range c.Modules {
+		for _, collector := range collectors {
+			if _, ok := collectorFactories[collector]; !ok {
+				return fmt.Errorf("modules: %s: unknown collector %s", name, collector)
+			}
+		}
+	}
+	if err := c.LabelFilters.Compile(); err != nil {
+		return fmt.Errorf("label_filters: %s", err)
+	}
+	if err := c.Cardinality.Compile(); err != nil {
+		return fmt.Errorf("cardinality: %s", err)
+	}
+	return nil
+}
+
+// The variables are passed as value of an envFlag, see command.go
+func validateEnv(env map[string]string) error {
+	for name, value := range env {
+		if name == "" || strings.ContainsAny(name, "=,") || strings.Contains(value, ",") {
+			return fmt.Errorf("invalid variable %s=%s", name, value)
+		}
+	}
+	return nil
+}
+
+// The variables as value of an envFlag, sorted by name
+func envValue(env map[string]string) string {
+	pairs := make([]string, 0, len(env))
+	for name, value := range env {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (tc TargetConfig) validate() error {
+	switch tc.Backend {
+	case "", "cli":
+		if tc.REST.URL != "" {
+			return fmt.Errorf("rest is only used by the rest backend")
+		}
+	case "rest":
+		if tc.REST.URL == "" {
+			return fmt.Errorf("rest: url is required by the rest backend")
+		}
+		if tc.Cluster != "" || tc.SlurmConf != "" {
+			return fmt.Errorf("cluster and slurm_conf are only used by the cli backend")
+		}
+	default:
+		return fmt.Errorf("backend: unknown backend %s, either cli or rest", tc.Backend)
+	}
+	return nil
+}
+
+// Returns the values of the flags set by the configuration
+func (c *Config) flags() map[string]string {
+	flags := make(map[string]string)
+	setString := func(name, value string) {
+		if value != "" {
+			flags[name] = value
+		}
+	}
+	setDuration := func(name string, value *time.Duration) {
+		if value != nil {
+			flags[name] = value.String()
+		}
+	}
+	setString("backend", c.Backend)
+	for name, enabled := range c.Collectors {
+		flags["collector."+name] = fmt.Sprint(enabled)
+	}
+	setString("cli.format", c.Commands.Format)
+	setDuration("command.timeout", c.Commands.Timeout)
+	for command, timeout := range c.Commands.Timeouts {
+		flags["command."+command+".timeout"] = timeout.String()
+	}
+	for command, path := range c.Commands.Paths {
+		setString("command."+command+".path", path)
+	}
+	setString("command.prefix", strings.Join(c.Commands.Prefix, " "))
+	if c.Commands.Quote != nil {
+		flags["command.quote"] = fmt.Sprint(*c.Commands.Quote)
+	}
+	setString("command.env", envValue(c.Commands.Env))
+	for command, env := range c.Commands.Envs {
+		setString("command."+command+".env", envValue(env))
+	}
+	setString("record.dir", c.Commands.RecordDir)
+	if c.Commands.RecordKeep != nil {
+		flags["record.keep"] = fmt.Sprint(*c.Commands.RecordKeep)
+	}
+	setString("replay.dir", c.Commands.ReplayDir)
+	setString("cluster", strings.Join(c.Clusters, ","))
+	setDuration("cache.interval", c.CacheInterval)
+	setDuration("cache.min-interval", c.CacheMinInterval)
+	setDuration("cache.max-age", c.CacheMaxAge)
+	for name, maxAge := range c.CacheMaxAges {
+		flags["collector."+name+".max-age"] = maxAge.String()
+	}
+	setString("rest.url", c.REST.URL)
+	setString("rest.api-version", c.REST.APIVersion)
+	setString("rest.user", c.REST.User)
+	setString("rest.token-file", c.REST.TokenFile)
+	setDuration("rest.timeout", c.REST.Timeout)
+	setString("push.url", c.Push.URL)
+	setDuration("push.interval", c.Push.Interval)
+	setString("push.job", c.Push.Job)
+	setString("push.grouping", c.Push.grouping())
+	setString("pseudonymize.key-file", c.Pseudonymize.KeyFile)
+	setString("pseudonymize.mapping.auth-file", c.Pseudonymize.MappingAuthFile)
+	setString("listen-address", c.Web.ListenAddress)
+	setString("web.config.file", c.Web.ConfigFile)
+	return flags
+}
+
+// The grouping labels as value of -push.grouping, sorted by name
+func (pc PushConfig) grouping() string {
+	pairs := make([]string, 0, len(pc.Grouping))
+	for name, value := range pc.Grouping {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+/*
+ * Set the flags to the values of the configuration, except the flags
+ * given on the command line. Only applied on startup for the flags read
+ * once, e.g. -listen-address, the collectors read the Settings built on
+ * every load instead (see settings.go).
+ */
+func (c *Config) Apply(explicit map[string]bool) error {
+	flags := c.flags()
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, flags[name]); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the names of the flags given on the command line
+func ExplicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
@@ -0,0 +1,193 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Restores the values of the flags set by the configuration
+func restoreFlags(config *Config) func() {
+	values := make(map[string]string)
+	for name := range config.flags() {
+		values[name] = flag.Lookup(name).Value.String()
+	}
+	return func() {
+		for name, value := range values {
+			flag.Set(name, value)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig("test_data/config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := NewSettings(config, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"accounts", "controller", "cpus", "nodes", "partitions", "queue", "scheduler", "users"}
+	if names := settings.Collectors; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected collectors %v, got %v", expected, names)
+	}
+	commands := settings.Commands
+	if timeout := commands.CommandTimeout("squeue"); timeout != 2*time.Minute {
+		t.Errorf("Expected a timeout of 2m for squeue, got %s", timeout)
+	}
+	if timeout := commands.CommandTimeout("sinfo"); timeout != time.Minute {
+		t.Errorf("Expected a timeout of 1m for sinfo, got %s", timeout)
+	}
+	if path := commands.CommandPath("sinfo"); path != "/opt/slurm/bin/sinfo" {
+		t.Errorf("Unexpected path of sinfo %s", path)
+	}
+	if name, args := commands.CommandLine("squeue"); name != "sudo" || strings.Join(commands.CommandEnv("squeue"), ",") != "SLURM_CONF=/etc/slurm/slurm.conf,SQUEUE_SORT=i" {
+		t.Errorf("Unexpected command line %s %v or environment of squeue %v", name, args, commands.CommandEnv("squeue"))
+	}
+	if settings.RecordKeep != 10 {
+		t.Errorf("Expected 10 scrapes to be kept, got %d", settings.RecordKeep)
+	}
+	if clusters := settings.Clusters; !reflect.DeepEqual(clusters, []string{"alpha", "beta"}) {
+		t.Errorf("Unexpected clusters %v", clusters)
+	}
+	if settings.Interval != 30*time.Second || settings.MinInterval != 10*time.Second || settings.Format != "text" {
+		t.Errorf("Unexpected cache interval %s, minimum interval %s or format %s", settings.Interval, settings.MinInterval, settings.Format)
+	}
+	if settings.MaxAges["fairshare"] != time.Hour || settings.MaxAges["scheduler"] != 5*time.Minute {
+		t.Errorf("Unexpected maximum ages %s and %s", settings.MaxAges["fairshare"], settings.MaxAges["scheduler"])
+	}
+	if flag.Lookup("command.prefix").Value.String() != "" || flag.Lookup("cache.interval").Value.String() != "0s" {
+		t.Errorf("Expected the settings to leave the flags unchanged")
+	}
+
+	// The flags read on startup are set by Apply
+	defer restoreFlags(config)()
+	if err := config.Apply(map[string]bool{"listen-address": true}); err != nil {
+		t.Fatal(err)
+	}
+	if *pushURL != "http://pushgateway:9091" || *pushInterval != 2*time.Minute || *pushGrouping != "instance=head1,site=gsi" {
+		t.Errorf("Unexpected push to %s every %s grouped by %s", *pushURL, *pushInterval, *pushGrouping)
+	}
+	if config.Targets["delta"].SlurmConf != "/etc/slurm-delta/slurm.conf" || len(config.Modules["jobs"]) != 3 {
+		t.Errorf("Unexpected targets %v or modules %v", config.Targets, config.Modules)
+	}
+	if limit := config.Cardinality["users"]; limit == nil || limit.TopN != 100 || !limit.Other {
+		t.Errorf("Unexpected cardinality limit of users %+v", limit)
+	}
+	// Flags given on the command line take precedence
+	if *listenAddress != ":8080" {
+		t.Errorf("Expected the listen address of the command line, got %s", *listenAddress)
+	}
+}
+
+func TestNewSettings(t *testing.T) {
+	quote := true
+	config := &Config{Commands: CommandsConfig{Prefix: []string{"ssh", "headnode"}, Quote: &quote, Timeout: new(time.Duration)}}
+	*config.Commands.Timeout = time.Minute
+	defer flag.Set("command.timeout", flag.Lookup("command.timeout").Value.String())
+	flag.Set("command.timeout", "5s")
+	settings, err := NewSettings(config, map[string]bool{"command.timeout": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags given on the command line take precedence
+	if timeout := settings.Commands.CommandTimeout("sinfo"); timeout != 5*time.Second {
+		t.Errorf("Expected the timeout of the command line, got %s", timeout)
+	}
+	if name, args := settings.Commands.CommandLine("sinfo", "-o %C"); name != "ssh" || args[2] != "'-o %C'" {
+		t.Errorf("Expected the quoted command line of the configuration, got %s %q", name, args)
+	}
+
+	// Unknown flags are an error
+	if _, err := NewSettings(&Config{}, map[string]bool{"command.unknown": true}); err == nil {
+		t.Error("Expected an error for an unknown flag")
+	}
+
+	// Settings removed from the configuration have their default
+	if settings, err = NewSettings(&Config{}, map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := settings.Commands.CommandLine("sinfo"); name != "sinfo" || settings.Commands.Timeout != 30*time.Second {
+		t.Errorf("Expected the default settings, got command %s and timeout %s", name, settings.Commands.Timeout)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for config, message := range map[string]string{
+		"collectors:\n  foo: true\n":                    "unknown collector foo",
+		"backend: rest\n":                               "url is required",
+		"commands:\n  timeouts:\n    scancel: 1m\n":     "unknown command scancel",
+		"commands:\n  envs:\n    sbatch:\n      A: b\n": "unknown command sbatch",
+		"commands:\n  prefix: [sudo -u slurm]\n":        "white space",
+		"commands:\n  record_keep: -1\n":                "negative record_keep",
+		"cache_interval: soon\n":                        "cannot unmarshal",
+		"cache_max_ages:\n  sdiag: 1m\n":                "unknown collector sdiag",
+		"label_filters:\n  user:\n    include: (\n":     "label user",
+		"listen_address: :8080\n":                       "not found",
+		"push:\n  interval: 0s\n":                       "interval must be positive",
+		"targets:\n  gamma:\n    backend: rest\n":       "url is required",
+		"modules:\n  jobs: [jobs]\n":                    "unknown collector jobs",
+		"push:\n  grouping:\n    job: slurm\n":          "invalid grouping label",
+	} {
+		file, err := ioutil.TempFile("", "config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(config)
+		file.Close()
+		_, err = LoadConfig(file.Name())
+		os.Remove(file.Name())
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected an error containing %q for %q, got %v", message, config, err)
+		}
+	}
+}
+
+func TestLabelFilters(t *testing.T) {
+	filters := LabelFilters{"user": {Exclude: "root|slurm"}, "partition": {Include: "main"}}
+	if err := filters.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	desc := prometheus.NewDesc("slurm_user_jobs_running", "Running jobs for user", []string{"user"}, nil)
+	collector := NewSlurmCollector(map[string]Collector{"users": &testCollector{
+		metrics: []prometheus.Metric{
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, "alice"),
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2, "root"),
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 3, "slurmuser"),
+		},
+		desc: desc,
+	}})
+	collector.SetLabelFilters(filters)
+	expected := `
+# HELP slurm_user_jobs_running Running jobs for user
+# TYPE slurm_user_jobs_running gauge
+slurm_user_jobs_running{user="alice"} 1
+slurm_user_jobs_running{user="slurmuser"} 3
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_user_jobs_running"); err != nil {
+		t.Error(err)
+	}
+}
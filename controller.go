@@ -0,0 +1,90 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The state of a slurmctld as reported by scontrol ping
+type ControllerStatus struct {
+	host string
+	role string
+	up   bool
+}
+
+// Execute the scontrol ping command and return its output
+func ControllerData(runner Runner) ([]byte, error) {
+	return runner.Run("scontrol", "ping")
+}
+
+// e.g. Slurmctld(primary) at ctl1 is UP
+var controllerPing = regexp.MustCompile(`^Slurmctld\((\w+)\) at (\S+) is (\w+)`)
+
+func ParseControllerStatus(input []byte) []ControllerStatus {
+	controllers := []ControllerStatus{}
+	for _, line := range strings.Split(string(input), "\n") {
+		match := controllerPing.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		controllers = append(controllers, ControllerStatus{
+			host: match[2],
+			role: match[1],
+			up:   match[3] == "UP",
+		})
+	}
+	return controllers
+}
+
+/*
+ * Implement the Collector interface (see collector.go) and feed the
+ * state of the controllers into it.
+ */
+
+func NewControllerCollector(backend Backend) *ControllerCollector {
+	return &ControllerCollector{
+		backend: backend,
+		up:      prometheus.NewDesc("slurm_controller_up", "Whether the slurmctld responds to a ping", []string{"host", "role"}, nil),
+	}
+}
+
+type ControllerCollector struct {
+	backend Backend
+	up      *prometheus.Desc
+}
+
+func (cc *ControllerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.up
+}
+
+func (cc *ControllerCollector) Update(ch chan<- prometheus.Metric) error {
+	controllers, err := cc.backend.Controllers()
+	if err != nil {
+		return err
+	}
+	for _, c := range controllers {
+		up := 0.0
+		if c.up {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(cc.up, prometheus.GaugeValue, up, c.host, c.role)
+	}
+	return nil
+}
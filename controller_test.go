@@ -0,0 +1,37 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestControllerCollector(t *testing.T) {
+	runner := testRunner{"scontrol ping": "test_data/scontrol_ping.txt"}
+	collector := NewSlurmCollector(map[string]Collector{"controller": NewControllerCollector(NewCLIBackend(runner))})
+	expected := `
+# HELP slurm_controller_up Whether the slurmctld responds to a ping
+# TYPE slurm_controller_up gauge
+slurm_controller_up{host="ctl1",role="primary"} 1
+slurm_controller_up{host="ctl2",role="backup"} 0
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_controller_up"); err != nil {
+		t.Error(err)
+	}
+}
@@ -17,10 +17,6 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
-	"log"
-	"os/exec"
-	"strconv"
 	"strings"
 )
 
@@ -31,47 +27,39 @@ type CPUsMetrics struct {
 	total float64
 }
 
-func CPUsGetMetrics() *CPUsMetrics {
-	return ParseCPUsMetrics(CPUsData())
+func CPUsGetMetrics(runner Runner) (*CPUsMetrics, error) {
+	data, err := CPUsData(runner)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCPUsMetrics(data), nil
 }
 
 func ParseCPUsMetrics(input []byte) *CPUsMetrics {
 	var cm CPUsMetrics
 	if strings.Contains(string(input), "/") {
 		splitted := strings.Split(strings.TrimSpace(string(input)), "/")
-		cm.alloc, _ = strconv.ParseFloat(splitted[0], 64)
-		cm.idle, _ = strconv.ParseFloat(splitted[1], 64)
-		cm.other, _ = strconv.ParseFloat(splitted[2], 64)
-		cm.total, _ = strconv.ParseFloat(splitted[3], 64)
+		cm.alloc = parseFloat("cpus", splitted[0])
+		cm.idle = parseFloat("cpus", splitted[1])
+		cm.other = parseFloat("cpus", splitted[2])
+		cm.total = parseFloat("cpus", splitted[3])
 	}
 	return &cm
 }
 
 // Execute the sinfo command and return its output
-func CPUsData() []byte {
-	cmd := exec.Command("sinfo", "-h", "-o %C")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+func CPUsData(runner Runner) ([]byte, error) {
+	return runner.Run("sinfo", "-h", "-o %C")
 }
 
 /*
- * Implement the Prometheus Collector interface and feed the
+ * Implement the Collector interface (see collector.go) and feed the
  * Slurm scheduler metrics into it.
- * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
  */
 
-func NewCPUsCollector() *CPUsCollector {
+func NewCPUsCollector(nodes *NodesSnapshot) *CPUsCollector {
 	return &CPUsCollector{
+		nodes: nodes,
 		alloc: prometheus.NewDesc("slurm_cpus_alloc", "Allocated CPUs", nil, nil),
 		idle:  prometheus.NewDesc("slurm_cpus_idle", "Idle CPUs", nil, nil),
 		other: prometheus.NewDesc("slurm_cpus_other", "Mix CPUs", nil, nil),
@@ -80,6 +68,7 @@ func NewCPUsCollector() *CPUsCollector {
 }
 
 type CPUsCollector struct {
+	nodes *NodesSnapshot
 	alloc *prometheus.Desc
 	idle  *prometheus.Desc
 	other *prometheus.Desc
@@ -93,10 +82,20 @@ func (cc *CPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.other
 	ch <- cc.total
 }
-func (cc *CPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	cm := CPUsGetMetrics()
+
+// Read the nodes again on the next update
+func (cc *CPUsCollector) Reset() {
+	cc.nodes.Reset()
+}
+
+func (cc *CPUsCollector) Update(ch chan<- prometheus.Metric) error {
+	cm, err := cc.nodes.CPUs()
+	if err != nil {
+		return err
+	}
 	ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.alloc)
 	ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.idle)
 	ch <- prometheus.MustNewConstMetric(cc.other, prometheus.GaugeValue, cm.other)
 	ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, cm.total)
+	return nil
 }
@@ -18,7 +18,10 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestCPUsMetrics(t *testing.T) {
@@ -32,5 +35,32 @@ func TestCPUsMetrics(t *testing.T) {
 }
 
 func TestCPUssGetMetrics(t *testing.T) {
-	t.Logf("%+v", CPUsGetMetrics())
+	metrics, err := CPUsGetMetrics(newFlagCommandRunner())
+	if err != nil {
+		t.Skipf("Can not execute sinfo: %v", err)
+	}
+	t.Logf("%+v", metrics)
+}
+
+func TestCPUsCollector(t *testing.T) {
+	runner := testRunner{"sinfo -h -o %C": "test_data/sinfo_cpus.txt"}
+	collector := NewSlurmCollector(map[string]Collector{"cpus": NewCPUsCollector(NewNodesSnapshot(NewCLIBackend(runner)))})
+	expected := `
+# HELP slurm_cpus_alloc Allocated CPUs
+# TYPE slurm_cpus_alloc gauge
+slurm_cpus_alloc 5725
+# HELP slurm_cpus_idle Idle CPUs
+# TYPE slurm_cpus_idle gauge
+slurm_cpus_idle 877
+# HELP slurm_cpus_other Mix CPUs
+# TYPE slurm_cpus_other gauge
+slurm_cpus_other 34
+# HELP slurm_cpus_total Total CPUs
+# TYPE slurm_cpus_total gauge
+slurm_cpus_total 6636
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_cpus_alloc", "slurm_cpus_idle", "slurm_cpus_other", "slurm_cpus_total"); err != nil {
+		t.Error(err)
+	}
 }
@@ -0,0 +1,93 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+/*
+ * A LabelFilter selects the series by the value of a label. A series is
+ * kept if the value matches the include regex and does not match the
+ * exclude regex, both are anchored like the relabeling of Prometheus.
+ * Series without the label are always kept.
+ */
+type LabelFilter struct {
+	Include string `yaml:"include"`
+	Exclude string `yaml:"exclude"`
+
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+func (f *LabelFilter) compile() error {
+	var err error
+	if f.Include != "" {
+		if f.include, err = regexp.Compile("^(?:" + f.Include + ")$"); err != nil {
+			return err
+		}
+	}
+	if f.Exclude != "" {
+		if f.exclude, err = regexp.Compile("^(?:" + f.Exclude + ")$"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *LabelFilter) keep(value string) bool {
+	if f.include != nil && !f.include.MatchString(value) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.MatchString(value)
+}
+
+// The label filters indexed by the label name
+type LabelFilters map[string]*LabelFilter
+
+// Compile the regexes of all filters
+func (lf LabelFilters) Compile() error {
+	for label, f := range lf {
+		if f == nil {
+			return fmt.Errorf("label %s: empty filter", label)
+		}
+		if err := f.compile(); err != nil {
+			return fmt.Errorf("label %s: %s", label, err)
+		}
+	}
+	return nil
+}
+
+// Returns false if the value of a label of the metric is filtered
+func (lf LabelFilters) Keep(m prometheus.Metric) bool {
+	if len(lf) == 0 {
+		return true
+	}
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil {
+		return true
+	}
+	for _, label := range metric.Label {
+		if f, ok := lf[label.GetName()]; ok && !f.keep(label.GetValue()) {
+			return false
+		}
+	}
+	return true
+}
@@ -4,5 +4,8 @@ go 1.12
 
 require (
 	github.com/prometheus/client_golang v1.2.1
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/prometheus/common v0.7.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	gopkg.in/yaml.v2 v2.2.2
 )
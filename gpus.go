@@ -17,11 +17,7 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
-	"io/ioutil"
-	"os/exec"
 	"strings"
-	"strconv"
 )
 
 type GPUsMetrics struct {
@@ -31,34 +27,41 @@ type GPUsMetrics struct {
 	utilization float64
 }
 
-func GPUsGetMetrics() *GPUsMetrics {
-	return ParseGPUsMetrics()
+func GPUsGetMetrics(runner Runner) (*GPUsMetrics, error) {
+	return ParseGPUsMetrics(runner)
 }
 
-func ParseAllocatedGPUs() float64 {
+func ParseAllocatedGPUs(runner Runner) (float64, error) {
 	var num_gpus = 0.0
 
 	args := []string{"-a", "-X", "--format=Allocgres", "--state=RUNNING", "--noheader", "--parsable2"}
-	output := string(Execute("sacct", args))
+	out, err := runner.Run("sacct", args...)
+	if err != nil {
+		return 0, err
+	}
+	output := string(out)
 	if len(output) > 0 {
 		for _, line := range strings.Split(output, "\n") {
 			if len(line) > 0 {
 				line = strings.Trim(line, "\"")
 				descriptor := strings.TrimPrefix(line, "gpu:")
-				job_gpus, _ := strconv.ParseFloat(descriptor, 64)
-				num_gpus += job_gpus
+				num_gpus += parseFloat("gpus", descriptor)
 			}
 		}
 	}
 
-	return num_gpus
+	return num_gpus, nil
 }
 
-func ParseTotalGPUs() float64 {
+func ParseTotalGPUs(runner Runner) (float64, error) {
 	var num_gpus = 0.0
 
 	args := []string{"-h", "-o \"%n %G\""}
-	output := string(Execute("sinfo", args))
+	out, err := runner.Run("sinfo", args...)
+	if err != nil {
+		return 0, err
+	}
+	output := string(out)
 	if len(output) > 0 {
 		for _, line := range strings.Split(output, "\n") {
 			if len(line) > 0 {
@@ -66,59 +69,51 @@ func ParseTotalGPUs() float64 {
 				descriptor := strings.Fields(line)[1]
 				descriptor = strings.TrimPrefix(descriptor, "gpu:")
 				descriptor = strings.Split(descriptor, "(")[0]
-				node_gpus, _ :=  strconv.ParseFloat(descriptor, 64)
-				num_gpus += node_gpus
+				// Nodes without GPUs print (null)
+				if descriptor != "" {
+					num_gpus += parseFloat("gpus", descriptor)
+				}
 			}
 		}
 	}
 
-	return num_gpus
+	return num_gpus, nil
 }
 
-func ParseGPUsMetrics() *GPUsMetrics {
+func ParseGPUsMetrics(runner Runner) (*GPUsMetrics, error) {
 	var gm GPUsMetrics
-	total_gpus := ParseTotalGPUs()
-	allocated_gpus := ParseAllocatedGPUs()
+	total_gpus, err := ParseTotalGPUs(runner)
+	if err != nil {
+		return nil, err
+	}
+	allocated_gpus, err := ParseAllocatedGPUs(runner)
+	if err != nil {
+		return nil, err
+	}
 	gm.alloc = allocated_gpus
 	gm.idle = total_gpus - allocated_gpus
 	gm.total = total_gpus
 	gm.utilization = allocated_gpus / total_gpus
-	return &gm
-}
-
-// Execute the sinfo command and return its output
-func Execute(command string, arguments []string) []byte {
-	cmd := exec.Command(command, arguments...)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+	return &gm, nil
 }
 
 /*
- * Implement the Prometheus Collector interface and feed the
+ * Implement the Collector interface (see collector.go) and feed the
  * Slurm scheduler metrics into it.
- * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
  */
 
-func NewGPUsCollector() *GPUsCollector {
+func NewGPUsCollector(nodes *NodesSnapshot) *GPUsCollector {
 	return &GPUsCollector{
-		alloc: prometheus.NewDesc("slurm_gpus_alloc", "Allocated GPUs", nil, nil),
-		idle:  prometheus.NewDesc("slurm_gpus_idle", "Idle GPUs", nil, nil),
-		total: prometheus.NewDesc("slurm_gpus_total", "Total GPUs", nil, nil),
+		nodes:       nodes,
+		alloc:       prometheus.NewDesc("slurm_gpus_alloc", "Allocated GPUs", nil, nil),
+		idle:        prometheus.NewDesc("slurm_gpus_idle", "Idle GPUs", nil, nil),
+		total:       prometheus.NewDesc("slurm_gpus_total", "Total GPUs", nil, nil),
 		utilization: prometheus.NewDesc("slurm_gpus_utilization", "Total GPU utilization", nil, nil),
 	}
 }
 
 type GPUsCollector struct {
+	nodes       *NodesSnapshot
 	alloc       *prometheus.Desc
 	idle        *prometheus.Desc
 	total       *prometheus.Desc
@@ -132,10 +127,20 @@ func (cc *GPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.total
 	ch <- cc.utilization
 }
-func (cc *GPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	cm := GPUsGetMetrics()
+
+// Read the nodes again on the next update
+func (cc *GPUsCollector) Reset() {
+	cc.nodes.Reset()
+}
+
+func (cc *GPUsCollector) Update(ch chan<- prometheus.Metric) error {
+	cm, err := cc.nodes.GPUs()
+	if err != nil {
+		return err
+	}
 	ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.alloc)
 	ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.idle)
 	ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, cm.total)
 	ch <- prometheus.MustNewConstMetric(cc.utilization, prometheus.GaugeValue, cm.utilization)
+	return nil
 }
@@ -0,0 +1,71 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/common/log"
+)
+
+// Implemented by backends which can check their requirements, e.g. installed commands
+type checker interface {
+	Check() error
+}
+
+// Returns an error unless the requirements of the backend are met and a slurmctld is up
+func Ready(backend Backend) error {
+	if c, ok := backend.(checker); ok {
+		if err := c.Check(); err != nil {
+			return err
+		}
+	}
+	controllers, err := backend.Controllers()
+	if err != nil {
+		return err
+	}
+	for _, c := range controllers {
+		if c.up {
+			return nil
+		}
+	}
+	return errors.New("no slurmctld is up")
+}
+
+// The exporter is alive as long as it serves HTTP requests
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+/*
+ * The exporter is ready if the Slurm commands are installed and a slurmctld
+ * of every cluster responds to a ping. This tells a broken exporter apart
+ * from an unreachable controller, the /healthz endpoint still succeeds.
+ */
+func readyHandler(backends []Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, backend := range backends {
+			if err := Ready(backend); err != nil {
+				log.Warnf("Not ready: %s", err)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
@@ -0,0 +1,49 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyHandler(t *testing.T) {
+	server := newTestRESTServer(t)
+	defer server.Close()
+	backend := newTestRESTBackend(t, server.URL)
+
+	recorder := httptest.NewRecorder()
+	readyHandler([]Backend{backend}).ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the exporter to be ready, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	// A missing command makes the exporter unready
+	cli := NewCLIBackend(testRunner{"scontrol ping": "test_data/scontrol_ping.txt"})
+	cli.settings.Commands.Paths["sinfo"] = "/nonexistent/sinfo"
+	recorder = httptest.NewRecorder()
+	readyHandler([]Backend{backend, cli}).ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the exporter to be unready, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	healthHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the exporter to be healthy, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,139 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A single job as listed by squeue
+type Job struct {
+	id        string
+	account   string
+	user      string
+	state     string
+	cpus      float64
+	partition string
+	reason    string
+	// The CPUs could not be parsed and are 0, see countCPUsParseErrors
+	cpusErr error
+	// The line could not be parsed, the job is dropped by the JobsSnapshot
+	lineErr error
+}
+
+/*
+ * Execute the squeue command for all jobs in all states and return its
+ * output, with all fields used by the queue, accounts, users and partitions
+ * collectors. The reason is the last field, it may contain the separator.
+ */
+func JobsData(runner Runner) ([]byte, error) {
+	return runner.Run("squeue", "-a", "-r", "-h", "-o %A|%a|%u|%T|%C|%P|%r", "--states=all")
+}
+
+func ParseJobs(input []byte) []Job {
+	jobs := []Job{}
+	lines := strings.Split(string(input), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "|", 7)
+		if len(fields) < 7 {
+			jobs = append(jobs, Job{lineErr: fmt.Errorf("expected 7 fields in %q", line)})
+			continue
+		}
+		// Counted by the collectors using the CPUs, the jobs are shared between collectors
+		cpus, err := strconv.ParseFloat(fields[4], 64)
+		jobs = append(jobs, Job{
+			id:        fields[0],
+			account:   fields[1],
+			user:      fields[2],
+			state:     fields[3],
+			cpus:      cpus,
+			partition: fields[5],
+			reason:    fields[6],
+			cpusErr:   err,
+		})
+	}
+	return jobs
+}
+
+// Counts the CPUs of the jobs which could not be parsed as parse errors of a collector using them
+func countCPUsParseErrors(collector string, jobs []Job) {
+	for _, job := range jobs {
+		if job.cpusErr != nil {
+			countParseError(collector, job.cpusErr) // from parse.go
+		}
+	}
+}
+
+/*
+ * The JobsSnapshot reads the jobs once from the backend and shares them
+ * between all collectors using it, so that their metrics are consistent
+ * with each other. The snapshot is reset before every update of the
+ * collectors.
+ */
+type JobsSnapshot struct {
+	backend Backend
+	mu      sync.Mutex
+	valid   bool
+	jobs    []Job
+	err     error
+	// The errors of the lines of the jobs which could not be parsed
+	lineErrs []error
+}
+
+func NewJobsSnapshot(backend Backend) *JobsSnapshot {
+	return &JobsSnapshot{backend: backend}
+}
+
+// Returns the jobs, they are only read from the backend on the first call after a reset
+func (s *JobsSnapshot) Jobs() ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.valid {
+		jobs, err := s.backend.Jobs()
+		s.jobs, s.err, s.lineErrs = nil, err, nil
+		for _, job := range jobs {
+			if job.lineErr != nil {
+				s.lineErrs = append(s.lineErrs, job.lineErr)
+				continue
+			}
+			s.jobs = append(s.jobs, job)
+		}
+		s.valid = true
+	}
+	return s.jobs, s.err
+}
+
+// Counts the lines of the jobs which could not be parsed as parse errors of a collector using the jobs
+func (s *JobsSnapshot) countParseErrors(collector string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, err := range s.lineErrs {
+		countParseError(collector, err) // from parse.go
+	}
+}
+
+func (s *JobsSnapshot) Reset() {
+	s.mu.Lock()
+	s.valid = false
+	s.mu.Unlock()
+}
@@ -0,0 +1,135 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Counts the executions of every command
+type countingRunner struct {
+	runner Runner
+	mu     sync.Mutex
+	runs   map[string]int
+}
+
+func (cr *countingRunner) Run(command string, args ...string) ([]byte, error) {
+	cr.mu.Lock()
+	cr.runs[command]++
+	cr.mu.Unlock()
+	return cr.runner.Run(command, args...)
+}
+
+func TestParseJobs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	jobs := ParseJobs(data)
+	if len(jobs) != 42 {
+		t.Fatalf("Expected 42 jobs, got %d", len(jobs))
+	}
+	expected := Job{id: "15452444", account: "hpc", user: "dave", state: "RUNNING", cpus: 16, partition: "main", reason: "None"}
+	if jobs[3] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, jobs[3])
+	}
+	// The reason is the last field and may contain the separator
+	jobs = ParseJobs([]byte("1|hpc|alice|PENDING|1|main|Reason|With|Separators\n"))
+	if len(jobs) != 1 || jobs[0].reason != "Reason|With|Separators" {
+		t.Errorf("Unexpected jobs %+v", jobs)
+	}
+}
+
+func TestJobsParseErrors(t *testing.T) {
+	file, err := ioutil.TempFile("", "squeue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("1|hpc|alice|RUNNING|N/A|main|None\n2|hpc|bob\n")
+	file.Close()
+	runner := testRunner{
+		"squeue -a -r -h -o %A|%a|%u|%T|%C|%P|%r --states=all": file.Name(),
+		"sinfo -h -o%R,%C": "test_data/sinfo_partitions.txt",
+	}
+	collectors, err := NewCollectors([]string{"accounts", "partitions", "queue", "users"}, NewCLIBackend(runner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errors := func(collector string) float64 {
+		return testutil.ToFloat64(parseErrorsTotal.WithLabelValues(collector))
+	}
+	before := map[string]float64{}
+	for _, collector := range []string{"accounts", "partitions", "queue", "users"} {
+		before[collector] = errors(collector)
+	}
+	gatherByCollector(t, NewSlurmCollector(collectors))
+	// The line without all fields is counted by every collector, the CPUs only by the collectors using them
+	for collector, expected := range map[string]float64{"accounts": 2, "partitions": 1, "queue": 1, "users": 2} {
+		if v := errors(collector) - before[collector]; v != expected {
+			t.Errorf("Expected %v parse errors of %s, got %v", expected, collector, v)
+		}
+	}
+}
+
+func TestJobsSnapshot(t *testing.T) {
+	runner := &countingRunner{
+		runner: testRunner{
+			"squeue -a -r -h -o %A|%a|%u|%T|%C|%P|%r --states=all": "test_data/squeue.txt",
+			"sinfo -h -o%R,%C": "test_data/sinfo_partitions.txt",
+		},
+		runs: make(map[string]int),
+	}
+	collectors, err := NewCollectors([]string{"accounts", "partitions", "queue", "users"}, NewCLIBackend(runner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewSlurmCollector(collectors)
+	expected := `
+# HELP slurm_account_jobs_pending Pending jobs for account
+# TYPE slurm_account_jobs_pending gauge
+slurm_account_jobs_pending{account="bio"} 2
+slurm_account_jobs_pending{account="hpc"} 1
+slurm_account_jobs_pending{account="phys"} 1
+# HELP slurm_partition_jobs_pending Pending jobs for partition
+# TYPE slurm_partition_jobs_pending gauge
+slurm_partition_jobs_pending{partition="main"} 3
+# HELP slurm_queue_pending Pending jobs in queue
+# TYPE slurm_queue_pending gauge
+slurm_queue_pending 4
+# HELP slurm_user_cpus_running Running cpus for user
+# TYPE slurm_user_cpus_running gauge
+slurm_user_cpus_running{user="alice"} 8
+slurm_user_cpus_running{user="bob"} 24
+slurm_user_cpus_running{user="carol"} 56
+slurm_user_cpus_running{user="dave"} 112
+`
+	for scrape := 1; scrape <= 2; scrape++ {
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+			"slurm_account_jobs_pending", "slurm_partition_jobs_pending", "slurm_queue_pending", "slurm_user_cpus_running"); err != nil {
+			t.Error(err)
+		}
+		if runner.runs["squeue"] != scrape {
+			t.Errorf("Expected squeue to be executed once per scrape, got %d executions in %d scrapes", runner.runs["squeue"], scrape)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+/*
+ * Releases of Slurm printing the --json output of a command in the format
+ * of the slurmrestd API parsed in rest.go. Since 23.02 sinfo prints its
+ * summary lines instead of the nodes and partitions.
+ */
+var jsonReleases = map[string]struct{ since, until float64 }{
+	"sdiag":  {22.05, 0},
+	"sinfo":  {21.08, 23.02},
+	"squeue": {21.08, 0},
+}
+
+/*
+ * Returns the commands parsed from their --json output. With the format
+ * "auto" the Slurm version is read from sinfo --version.
+ */
+func JSONCommands(runner Runner, format string) (map[string]bool, error) {
+	commands := make(map[string]bool)
+	switch format {
+	case "text":
+		return commands, nil
+	case "json":
+		for command := range jsonReleases {
+			commands[command] = true
+		}
+		return commands, nil
+	case "auto":
+		data, err := SlurmVersionData(runner) // from version.go
+		if err != nil {
+			return commands, err
+		}
+		_, major, minor, err := ParseSlurmVersion(data)
+		if err != nil {
+			return commands, err
+		}
+		// The release is compared as a number, e.g. 21.08
+		release, _ := strconv.ParseFloat(major+"."+minor, 64)
+		for command, r := range jsonReleases {
+			commands[command] = release >= r.since && (r.until == 0 || release < r.until)
+		}
+		return commands, nil
+	}
+	return commands, fmt.Errorf("unknown format %s", format)
+}
+
+func SqueueJSONData(runner Runner) ([]byte, error) {
+	return runner.Run("squeue", "-a", "-r", "--states=all", "--json")
+}
+
+func SinfoJSONData(runner Runner) ([]byte, error) {
+	return runner.Run("sinfo", "--json")
+}
+
+func SdiagJSONData(runner Runner) ([]byte, error) {
+	return runner.Run("sdiag", "--json")
+}
+
+func ParseJobsJSON(input []byte) ([]Job, error) {
+	var resp restJobsResponse
+	if err := decodeJSON("squeue", input, &resp); err != nil {
+		return nil, err
+	}
+	return restJobs(resp.Jobs), nil
+}
+
+// The output of sinfo --json contains the nodes and the partitions
+type sinfoJSON struct {
+	restErrors
+	Nodes      []restNode      `json:"nodes"`
+	Partitions []restPartition `json:"partitions"`
+}
+
+func ParseSinfoJSON(input []byte) ([]restNode, []restPartition, error) {
+	var resp sinfoJSON
+	if err := decodeJSON("sinfo", input, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Nodes, resp.Partitions, nil
+}
+
+func ParseSchedulerJSON(input []byte) (*SchedulerMetrics, error) {
+	var resp restDiagResponse
+	if err := decodeJSON("sdiag", input, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Statistics.metrics(), nil
+}
+
+func decodeJSON(command string, input []byte, v restResult) error {
+	if err := json.Unmarshal(input, v); err != nil {
+		return fmt.Errorf("%s: %s", command, err)
+	}
+	if err := v.err(); err != nil {
+		return fmt.Errorf("%s: %s", command, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseJobsJSON(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue.json")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	jobs, err := ParseJobsJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The separators of the text output may be part of the fields
+	expected := Job{id: "1002", account: "hpc", user: "bob", state: "PENDING", cpus: 8, partition: "main", reason: "ReqNodeNotAvail, UnavailableNodes:n[05-06]"}
+	if len(jobs) != 5 || jobs[1] != expected {
+		t.Errorf("Unexpected jobs %+v", jobs)
+	}
+	// Newer releases print the state as list and wrap the numbers
+	jobs, err = ParseJobsJSON([]byte(`{"jobs": [{"job_id": 7, "account": "hpc", "user_name": "alice", "job_state": ["RUNNING"],
+		"cpus": {"set": true, "infinite": false, "number": 4}, "partition": "main", "state_reason": "None"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = Job{id: "7", account: "hpc", user: "alice", state: "RUNNING", cpus: 4, partition: "main", reason: "None"}
+	if len(jobs) != 1 || jobs[0] != expected {
+		t.Errorf("Unexpected jobs %+v", jobs)
+	}
+	if _, err := ParseJobsJSON([]byte("JOBID PARTITION")); err == nil {
+		t.Error("Expected an error for the text output")
+	}
+}
+
+func TestJSONCommands(t *testing.T) {
+	for format, expected := range map[string]map[string]bool{
+		"text": {},
+		"json": {"sdiag": true, "sinfo": true, "squeue": true},
+		"auto": {"sdiag": false, "sinfo": true, "squeue": true},
+	} {
+		commands, err := JSONCommands(testRunner{"sinfo --version": "test_data/sinfo_version.txt"}, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(commands, expected) {
+			t.Errorf("Expected %v for format %s, got %v", expected, format, commands)
+		}
+	}
+	if _, err := JSONCommands(testRunner{}, "auto"); err == nil {
+		t.Error("Expected an error without sinfo")
+	}
+}
+
+func TestCLIBackendJSON(t *testing.T) {
+	backend := NewCLIBackend(testRunner{
+		"sinfo --json":                     "test_data/sinfo.json",
+		"sdiag --json":                     "test_data/sdiag.json",
+		"squeue -a -r --states=all --json": "test_data/squeue.json",
+	})
+	backend.json = map[string]bool{"sdiag": true, "sinfo": true, "squeue": true}
+	collectors, err := NewCollectors([]string{"cpus", "nodes", "partitions", "queue", "scheduler"}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewSlurmCollector(collectors)
+	expected := `
+# HELP slurm_cpus_other Mix CPUs
+# TYPE slurm_cpus_other gauge
+slurm_cpus_other 48
+# HELP slurm_nodes_comp Completing nodes
+# TYPE slurm_nodes_comp gauge
+slurm_nodes_comp 1
+# HELP slurm_partition_cpus_idle Idle CPUs for partition
+# TYPE slurm_partition_cpus_idle gauge
+slurm_partition_cpus_idle{partition="debug"} 40
+slurm_partition_cpus_idle{partition="main"} 48
+# HELP slurm_queue_running Running jobs in the cluster
+# TYPE slurm_queue_running gauge
+slurm_queue_running 2
+# HELP slurm_scheduler_last_cycle Information provided by the Slurm sdiag command, scheduler last cycle time in (microseconds)
+# TYPE slurm_scheduler_last_cycle gauge
+slurm_scheduler_last_cycle 97209
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_cpus_other", "slurm_nodes_comp", "slurm_partition_cpus_idle", "slurm_queue_running", "slurm_scheduler_last_cycle"); err != nil {
+		t.Error(err)
+	}
+}
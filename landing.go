@@ -0,0 +1,73 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<html>
+<head><title>Prometheus Slurm Exporter</title></head>
+<body>
+<h1>Prometheus Slurm Exporter</h1>
+<p>Version {{.Version}}</p>
+<p><a href="/metrics">Metrics</a></p>
+<h2>Clusters</h2>
+<table>
+<tr><th>Cluster</th><th>Slurm version</th></tr>
+{{range .Clusters}}<tr><td>{{if .Name}}{{.Name}}{{else}}local{{end}}</td><td>{{if .Version}}{{.Version}}{{else}}unknown{{end}}</td></tr>
+{{end}}</table>
+<h2>Enabled collectors</h2>
+<ul>
+{{range .Collectors}}<li>{{.}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// A cluster listed on the landing page, the name is empty for the local cluster
+type landingCluster struct {
+	Name string
+	info *SlurmInfo
+}
+
+func (lc landingCluster) Version() string {
+	return lc.info.Version()
+}
+
+// Lists the enabled collectors and the version of Slurm of every cluster
+func landingHandler(collectors []string, clusters []landingCluster) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The pattern "/" matches all paths without another handler
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := landingTemplate.Execute(w, struct {
+			Version    string
+			Clusters   []landingCluster
+			Collectors []string
+		}{version.Version, clusters, collectors})
+		if err != nil {
+			log.Errorf("Can not render the landing page: %s", err)
+		}
+	})
+}
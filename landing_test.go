@@ -0,0 +1,43 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLandingHandler(t *testing.T) {
+	clusters := []landingCluster{
+		{Name: "alpha", info: NewSlurmInfo(NewCLIBackend(testRunner{"sinfo --version": "test_data/sinfo_version.txt"}))},
+		{Name: "beta", info: NewSlurmInfo(NewCLIBackend(testRunner{}))},
+	}
+	handler := landingHandler([]string{"cpus", "nodes"}, clusters)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	body := recorder.Body.String()
+	for _, s := range []string{`<a href="/metrics">`, "<td>alpha</td><td>21.08.8</td>", "<td>beta</td><td>unknown</td>", "<li>cpus</li>", "<li>nodes</li>"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Expected %q on the landing page:\n%s", s, body)
+		}
+	}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/unknown", nil))
+	if recorder.Code != 404 {
+		t.Errorf("Expected 404 for an unknown path, got %d", recorder.Code)
+	}
+}
@@ -16,26 +16,19 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-func init() {
-	// Metrics have to be registered to be exposed
-	prometheus.MustRegister(NewAccountsCollector())       // from accounts.go
-	prometheus.MustRegister(NewCPUsCollector())           // from cpus.go
-	prometheus.MustRegister(NewGPUsCollector())           // from gpus.go
-	prometheus.MustRegister(NewNodesCollector())          // from nodes.go
-	prometheus.MustRegister(NewPartitionsCollector())     // from partitions.go
-	prometheus.MustRegister(NewQueueCollector())          // from queue.go
-	prometheus.MustRegister(NewSchedulerCollector())      // from scheduler.go
-	prometheus.MustRegister(NewFairShareCollector())      // from sshare.go
-	prometheus.MustRegister(NewUsersCollector())          // from users.go
-}
-
 var listenAddress = flag.String(
 	"listen-address",
 	":8080",
@@ -43,9 +36,138 @@ var listenAddress = flag.String(
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.Print("prometheus-slurm-exporter"))
+		os.Exit(0)
+	}
+	// The flags given on the command line take precedence over the configuration file
+	explicit := ExplicitFlags() // from config.go
+	if *configFile != "" {
+		config, err := LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %s", err)
+		}
+		if err := config.Apply(explicit); err != nil {
+			log.Fatalf("Invalid configuration: %s", err)
+		}
+	}
+	if *configCheck {
+		if *configFile == "" {
+			log.Fatal("No configuration file given with -config.file")
+		}
+		if *webConfigFile != "" {
+			if _, err := LoadWebServerConfig(*webConfigFile); err != nil {
+				log.Fatalf("Invalid web configuration: %s", err)
+			}
+		}
+		fmt.Printf("Configuration file %s is valid\n", *configFile)
+		os.Exit(0)
+	}
+	log.Infof("Starting prometheus-slurm-exporter %s", version.Info())
+	log.Infof("Build context %s", version.BuildContext())
+	var pseudonymizer *Pseudonymizer
+	if *pseudonymizeKeyFile != "" {
+		var err error
+		pseudonymizer, err = LoadPseudonymizer(*pseudonymizeKeyFile) // from pseudonym.go
+		if err != nil {
+			log.Fatalf("Invalid pseudonymization key: %s", err)
+		}
+		log.Info("Replacing user names by pseudonyms")
+	}
+	// The collectors of all clusters, rebuilt on reload
+	exporter := NewExporter(explicit, pseudonymizer, *outputTextfile == "") // from reload.go
+	if err := exporter.Load(); err != nil {
+		log.Fatal(err)
+	}
+	// The textfile only contains the metrics of the Slurm collectors and
+	// the exporter, node_exporter exports the metrics of its own process
+	var registerer prometheus.Registerer = prometheus.DefaultRegisterer
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *outputTextfile != "" {
+		registry := prometheus.NewRegistry()
+		registerer, gatherer = registry, registry
+	}
+	gatherer = prometheus.Gatherers{gatherer, exporter}
+	registerer.MustRegister(commandTimeoutsTotal)    // from command.go
+	registerer.MustRegister(commandDuration)         // from command.go
+	registerer.MustRegister(commandExecutionsTotal)  // from command.go
+	registerer.MustRegister(commandOutputBytesTotal) // from command.go
+	registerer.MustRegister(parseErrorsTotal)        // from parse.go
+	registerer.MustRegister(seriesDroppedTotal)      // from cardinality.go
+	registerer.MustRegister(version.NewCollector("slurm_exporter"))
+	if *outputTextfile != "" {
+		if err := WriteTextfile(gatherer, *outputTextfile); err != nil { // from textfile.go
+			log.Fatalf("Can not write the metrics to %s: %s", *outputTextfile, err)
+		}
+		log.Infof("Wrote the metrics to %s", *outputTextfile)
+		os.Exit(0)
+	}
+	if *pushURL != "" {
+		grouping, err := ParseGrouping(*pushGrouping) // from push.go
+		if err != nil {
+			log.Fatalf("Invalid -push.grouping: %s", err)
+		}
+		pusher := NewPusher(*pushURL, *pushJob, grouping, gatherer, *pushInterval)
+		registerer.MustRegister(pusher)
+		log.Infof("Pushing to %s every %s", *pushURL, *pushInterval)
+		pusher.Start(*pushInterval)
+	}
 	// The Handler function provides a default handler to expose metrics
 	// via an HTTP server. "/metrics" is the usual endpoint for that.
 	log.Infof("Starting Server: %s", *listenAddress)
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(registerer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})))
+	http.Handle("/", exporter.LandingHandler())     // from landing.go
+	http.HandleFunc("/healthz", healthHandler)      // from health.go
+	http.Handle("/readyz", exporter.ReadyHandler()) // from health.go
+	// Collects from the targets of the configuration file
+	http.Handle("/probe", exporter.ProbeHandler()) // from probe.go
+	// Anyone reaching the exporter could reload it, SIGHUP always reloads
+	if *webEnableLifecycle {
+		http.Handle("/-/reload", exporter.ReloadHandler()) // from reload.go
+	}
+	if *pseudonymizeMappingAuthFile != "" {
+		if pseudonymizer == nil {
+			log.Fatal("The pseudonym mapping requires -pseudonymize.key-file")
+		}
+		mapping, err := PseudonymMappingHandler(pseudonymizer, *pseudonymizeMappingAuthFile)
+		if err != nil {
+			log.Fatalf("Invalid pseudonym mapping: %s", err)
+		}
+		http.Handle("/pseudonyms", mapping)
+	}
+	// Serves all handlers with TLS and authentication if configured
+	server, err := NewWebServer(http.DefaultServeMux, *webConfigFile) // from web.go
+	if err != nil {
+		log.Fatalf("Invalid web configuration: %s", err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe(*listenAddress)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case err := <-errs:
+			log.Fatal(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err := exporter.Load(); err != nil {
+					log.Errorf("Reload failed: %s", err)
+				} else {
+					log.Info("Reloaded the configuration")
+				}
+				continue
+			}
+			log.Infof("Received %s, shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			if err := server.Shutdown(ctx); err != nil {
+				log.Warnf("Requests still in flight after %s: %s", *shutdownTimeout, err)
+			}
+			cancel()
+			// Kill the Slurm commands still running, e.g. of the polling collectors
+			CancelCommands() // from command.go
+			return
+		}
+	}
 }
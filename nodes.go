@@ -17,13 +17,10 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
-	"log"
-	"os/exec"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
 )
 
 type NodesMetrics struct {
@@ -39,8 +36,12 @@ type NodesMetrics struct {
 	resv  float64
 }
 
-func NodesGetMetrics() *NodesMetrics {
-	return ParseNodesMetrics(NodesData())
+func NodesGetMetrics(runner Runner) (*NodesMetrics, error) {
+	data, err := NodesData(runner)
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodesMetrics(data), nil
 }
 
 func RemoveDuplicates(s []string) []string {
@@ -69,70 +70,162 @@ func ParseNodesMetrics(input []byte) *NodesMetrics {
 	for _, line := range lines_uniq {
 		if strings.Contains(line, ",") {
 			split := strings.Split(line, ",")
-			count, _ := strconv.ParseFloat(strings.TrimSpace(split[0]), 64)
-			state := split[1]
-			alloc := regexp.MustCompile(`^alloc`)
-			comp := regexp.MustCompile(`^comp`)
-			down := regexp.MustCompile(`^down`)
-			drain := regexp.MustCompile(`^drain`)
-			fail := regexp.MustCompile(`^fail`)
-			err := regexp.MustCompile(`^err`)
-			idle := regexp.MustCompile(`^idle`)
-			maint := regexp.MustCompile(`^maint`)
-			mix := regexp.MustCompile(`^mix`)
-			resv := regexp.MustCompile(`^res`)
-			switch {
-			case alloc.MatchString(state) == true:
-				nm.alloc += count
-			case comp.MatchString(state) == true:
-				nm.comp += count
-			case down.MatchString(state) == true:
-				nm.down += count
-			case drain.MatchString(state) == true:
-				nm.drain += count
-			case fail.MatchString(state) == true:
-				nm.fail += count
-			case err.MatchString(state) == true:
-				nm.err += count
-			case idle.MatchString(state) == true:
-				nm.idle += count
-			case maint.MatchString(state) == true:
-				nm.maint += count
-			case mix.MatchString(state) == true:
-				nm.mix += count
-			case resv.MatchString(state) == true:
-				nm.resv += count
-			}
+			count := parseFloat("nodes", strings.TrimSpace(split[0]))
+			nm.add(split[1], count)
 		}
 	}
 	return &nm
 }
 
+// Accumulate the number of nodes by their state as printed by sinfo
+func (nm *NodesMetrics) add(state string, count float64) {
+	alloc := regexp.MustCompile(`^alloc`)
+	comp := regexp.MustCompile(`^comp`)
+	down := regexp.MustCompile(`^down`)
+	drain := regexp.MustCompile(`^drain`)
+	fail := regexp.MustCompile(`^fail`)
+	err := regexp.MustCompile(`^err`)
+	idle := regexp.MustCompile(`^idle`)
+	maint := regexp.MustCompile(`^maint`)
+	mix := regexp.MustCompile(`^mix`)
+	resv := regexp.MustCompile(`^res`)
+	switch {
+	case alloc.MatchString(state) == true:
+		nm.alloc += count
+	case comp.MatchString(state) == true:
+		nm.comp += count
+	case down.MatchString(state) == true:
+		nm.down += count
+	case drain.MatchString(state) == true:
+		nm.drain += count
+	case fail.MatchString(state) == true:
+		nm.fail += count
+	case err.MatchString(state) == true:
+		nm.err += count
+	case idle.MatchString(state) == true:
+		nm.idle += count
+	case maint.MatchString(state) == true:
+		nm.maint += count
+	case mix.MatchString(state) == true:
+		nm.mix += count
+	case resv.MatchString(state) == true:
+		nm.resv += count
+	}
+}
+
 // Execute the sinfo command and return its output
-func NodesData() []byte {
-	cmd := exec.Command("sinfo", "-h", "-o %D,%T")
-	stdout, err := cmd.StdoutPipe()
+func NodesData(runner Runner) ([]byte, error) {
+	return runner.Run("sinfo", "-h", "-o %D,%T")
+}
+
+// The nodes and partitions returned at once by slurmrestd or sinfo --json
+type nodesData struct {
+	nodes      []restNode
+	partitions []restPartition // nil if not read together with the nodes
+}
+
+/*
+ * Implemented by the backends reading all nodes at once. The CPUs and the
+ * nodes are counted from the nodes, the GPUs and the partitions by the
+ * backend, which may read more data for them.
+ */
+type nodesReader interface {
+	readNodes() (*nodesData, error)
+	gpus(data *nodesData) (*GPUsMetrics, error)
+	partitions(data *nodesData) (map[string]*PartitionMetrics, error)
+}
+
+/*
+ * The NodesSnapshot reads the nodes once from the backend and shares them
+ * between the cpus, gpus, nodes and partitions collectors, like the
+ * JobsSnapshot does for the jobs. The text output of sinfo is read by
+ * every collector with its own format instead.
+ */
+type NodesSnapshot struct {
+	backend Backend
+	mu      sync.Mutex
+	valid   bool
+	data    *nodesData
+	err     error
+}
+
+func NewNodesSnapshot(backend Backend) *NodesSnapshot {
+	return &NodesSnapshot{backend: backend}
+}
+
+// Returns the nodes, they are only read from the backend on the first call after a reset
+func (s *NodesSnapshot) read() (nodesReader, *nodesData, error) {
+	reader, ok := s.backend.(nodesReader)
+	if !ok {
+		return nil, nil, errNotSupported
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.valid {
+		s.data, s.err = reader.readNodes()
+		s.valid = true
+	}
+	return reader, s.data, s.err
+}
+
+func (s *NodesSnapshot) CPUs() (*CPUsMetrics, error) {
+	_, data, err := s.read()
+	if err == errNotSupported {
+		return s.backend.CPUs()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return restCPUsMetrics(data.nodes), nil
+}
+
+func (s *NodesSnapshot) GPUs() (*GPUsMetrics, error) {
+	reader, data, err := s.read()
+	if err == errNotSupported {
+		return s.backend.GPUs()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reader.gpus(data)
+}
+
+func (s *NodesSnapshot) Nodes() (*NodesMetrics, error) {
+	_, data, err := s.read()
+	if err == errNotSupported {
+		return s.backend.Nodes()
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	return restNodesMetrics(data.nodes), nil
+}
+
+func (s *NodesSnapshot) Partitions() (map[string]*PartitionMetrics, error) {
+	reader, data, err := s.read()
+	if err == errNotSupported {
+		return s.backend.Partitions()
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	if err != nil {
+		return nil, err
 	}
-	return out
+	return reader.partitions(data)
+}
+
+func (s *NodesSnapshot) Reset() {
+	s.mu.Lock()
+	s.valid = false
+	s.mu.Unlock()
 }
 
 /*
- * Implement the Prometheus Collector interface and feed the
+ * Implement the Collector interface (see collector.go) and feed the
  * Slurm scheduler metrics into it.
- * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
  */
 
-func NewNodesCollector() *NodesCollector {
+func NewNodesCollector(nodes *NodesSnapshot) *NodesCollector {
 	return &NodesCollector{
+		nodes: nodes,
 		alloc: prometheus.NewDesc("slurm_nodes_alloc", "Allocated nodes", nil, nil),
 		comp:  prometheus.NewDesc("slurm_nodes_comp", "Completing nodes", nil, nil),
 		down:  prometheus.NewDesc("slurm_nodes_down", "Down nodes", nil, nil),
@@ -147,6 +240,7 @@ func NewNodesCollector() *NodesCollector {
 }
 
 type NodesCollector struct {
+	nodes *NodesSnapshot
 	alloc *prometheus.Desc
 	comp  *prometheus.Desc
 	down  *prometheus.Desc
@@ -172,8 +266,17 @@ func (nc *NodesCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- nc.mix
 	ch <- nc.resv
 }
-func (nc *NodesCollector) Collect(ch chan<- prometheus.Metric) {
-	nm := NodesGetMetrics()
+
+// Read the nodes again on the next update
+func (nc *NodesCollector) Reset() {
+	nc.nodes.Reset()
+}
+
+func (nc *NodesCollector) Update(ch chan<- prometheus.Metric) error {
+	nm, err := nc.nodes.Nodes()
+	if err != nil {
+		return err
+	}
 	ch <- prometheus.MustNewConstMetric(nc.alloc, prometheus.GaugeValue, nm.alloc)
 	ch <- prometheus.MustNewConstMetric(nc.comp, prometheus.GaugeValue, nm.comp)
 	ch <- prometheus.MustNewConstMetric(nc.down, prometheus.GaugeValue, nm.down)
@@ -184,4 +287,5 @@ func (nc *NodesCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(nc.maint, prometheus.GaugeValue, nm.maint)
 	ch <- prometheus.MustNewConstMetric(nc.mix, prometheus.GaugeValue, nm.mix)
 	ch <- prometheus.MustNewConstMetric(nc.resv, prometheus.GaugeValue, nm.resv)
+	return nil
 }
@@ -17,7 +17,11 @@ package main
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -32,5 +36,54 @@ func TestNodesMetrics(t *testing.T) {
 }
 
 func TestNodesGetMetrics(t *testing.T) {
-	t.Logf("%+v", NodesGetMetrics())
+	metrics, err := NodesGetMetrics(newFlagCommandRunner())
+	if err != nil {
+		t.Skipf("Can not execute sinfo: %v", err)
+	}
+	t.Logf("%+v", metrics)
+}
+
+func TestNodesSnapshot(t *testing.T) {
+	runner := &countingRunner{
+		runner: testRunner{"sinfo --json": "test_data/sinfo.json"},
+		runs:   make(map[string]int),
+	}
+	backend := NewCLIBackend(runner)
+	backend.json = map[string]bool{"sinfo": true}
+	collectors, err := NewCollectors([]string{"cpus", "nodes", "partitions"}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for scrape := 1; scrape <= 2; scrape++ {
+		gatherByCollector(t, NewSlurmCollector(collectors))
+		if runner.runs["sinfo"] != scrape {
+			t.Errorf("Expected sinfo to be executed once per scrape, got %d executions in %d scrapes", runner.runs["sinfo"], scrape)
+		}
+	}
+}
+
+func TestNodesSnapshotREST(t *testing.T) {
+	server := newTestRESTServer(t)
+	defer server.Close()
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[strings.TrimPrefix(r.URL.Path, "/slurm/v0.0.37/")]++
+		mu.Unlock()
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counting.Close()
+	collectors, err := NewCollectors([]string{"cpus", "gpus", "nodes", "partitions"}, newTestRESTBackend(t, counting.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for scrape := 1; scrape <= 2; scrape++ {
+		gatherByCollector(t, NewSlurmCollector(collectors))
+		mu.Lock()
+		if requests["nodes"] != scrape {
+			t.Errorf("Expected the nodes to be requested once per scrape, got %d requests in %d scrapes", requests["nodes"], scrape)
+		}
+		mu.Unlock()
+	}
 }
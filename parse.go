@@ -0,0 +1,48 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var parseErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "slurm_exporter_parse_errors_total",
+	Help: "Number of values in the output of the Slurm commands which could not be parsed",
+}, []string{"collector"})
+
+/*
+ * Parses a number in the output of a command of a collector. A value which
+ * is not a number is counted as parse error of the collector and read as 0,
+ * so that a single unexpected field does not fail the whole scrape.
+ */
+func parseFloat(collector, s string) float64 {
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		countParseError(collector, err)
+		return 0
+	}
+	return value
+}
+
+// Counts a value which could not be parsed as parse error of the collector using it
+func countParseError(collector string, err error) {
+	parseErrorsTotal.WithLabelValues(collector).Inc()
+	log.Debugf("Can not parse the output of the %s collector: %s", collector, err)
+}
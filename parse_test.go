@@ -0,0 +1,61 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseFloat(t *testing.T) {
+	before := testutil.ToFloat64(parseErrorsTotal.WithLabelValues("test"))
+	if v := parseFloat("test", "42.5"); v != 42.5 {
+		t.Errorf("Expected 42.5, got %v", v)
+	}
+	if v := parseFloat("test", "N/A"); v != 0 {
+		t.Errorf("Expected 0 for a value which is not a number, got %v", v)
+	}
+	if errs := testutil.ToFloat64(parseErrorsTotal.WithLabelValues("test")) - before; errs != 1 {
+		t.Errorf("Expected 1 parse error, got %v", errs)
+	}
+}
+
+// The test data of the parsers must not contain values which can not be parsed
+func TestParseErrors(t *testing.T) {
+	parsers := []struct {
+		collector string
+		file      string
+		parse     func([]byte)
+	}{
+		{"cpus", "test_data/sinfo_cpus.txt", func(data []byte) { ParseCPUsMetrics(data) }},
+		{"partitions", "test_data/sinfo_partitions.txt", func(data []byte) { ParsePartitionsMetrics(data) }},
+		{"scheduler", "test_data/sdiag.txt", func(data []byte) { ParseSchedulerMetrics(data) }},
+		{"users", "test_data/squeue.txt", func(data []byte) { countCPUsParseErrors("users", ParseJobs(data)) }},
+	}
+	for _, p := range parsers {
+		data, err := ioutil.ReadFile(p.file)
+		if err != nil {
+			t.Fatalf("Can not read test data: %v", err)
+		}
+		before := testutil.ToFloat64(parseErrorsTotal.WithLabelValues(p.collector))
+		p.parse(data)
+		if errs := testutil.ToFloat64(parseErrorsTotal.WithLabelValues(p.collector)) - before; errs != 0 {
+			t.Errorf("%s: expected no parse errors, got %v", p.file, errs)
+		}
+	}
+}
@@ -16,134 +16,124 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
-        "strings"
-        "strconv"
-        "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
 )
 
-func PartitionsData() []byte {
-        cmd := exec.Command("sinfo", "-h", "-o%R,%C")
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
-        }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
-        }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
-        }
-        return out
+func PartitionsData(runner Runner) ([]byte, error) {
+	return runner.Run("sinfo", "-h", "-o%R,%C")
 }
 
-func PartitionsPendingJobsData() []byte {
-        cmd := exec.Command("squeue","-a","-r","-h","-o%P","--states=PENDING")
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
-        }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
-        }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
-        }
-        return out
+type PartitionMetrics struct {
+	allocated float64
+	idle      float64
+	other     float64
+	pending   float64
+	total     float64
 }
 
-type PartitionMetrics struct {
-        allocated float64
-        idle float64
-        other float64
-        pending float64
-        total float64
+func ParsePartitionsMetrics(input []byte) map[string]*PartitionMetrics {
+	partitions := make(map[string]*PartitionMetrics)
+	lines := strings.Split(string(input), "\n")
+	for _, line := range lines {
+		if strings.Contains(line, ",") {
+			// name of a partition
+			partition := strings.Split(line, ",")[0]
+			_, key := partitions[partition]
+			if !key {
+				partitions[partition] = &PartitionMetrics{0, 0, 0, 0, 0}
+			}
+			states := strings.Split(line, ",")[1]
+			allocated := parseFloat("partitions", strings.Split(states, "/")[0])
+			idle := parseFloat("partitions", strings.Split(states, "/")[1])
+			other := parseFloat("partitions", strings.Split(states, "/")[2])
+			total := parseFloat("partitions", strings.Split(states, "/")[3])
+			partitions[partition].allocated = allocated
+			partitions[partition].idle = idle
+			partitions[partition].other = other
+			partitions[partition].total = total
+		}
+	}
+	return partitions
 }
 
-func ParsePartitionsMetrics() map[string]*PartitionMetrics {
-        partitions := make(map[string]*PartitionMetrics)
-        lines := strings.Split(string(PartitionsData()), "\n")
-        for _, line := range lines {
-                if strings.Contains(line,",") {
-                        // name of a partition
-                        partition := strings.Split(line,",")[0]
-                        _,key := partitions[partition]
-                        if !key {
-                                partitions[partition] = &PartitionMetrics{0,0,0,0,0}
-                        }
-                        states := strings.Split(line,",")[1]
-                        allocated,_ := strconv.ParseFloat(strings.Split(states,"/")[0],64)
-                        idle,_ := strconv.ParseFloat(strings.Split(states,"/")[1],64)
-                        other,_ := strconv.ParseFloat(strings.Split(states,"/")[2],64)
-                        total,_ := strconv.ParseFloat(strings.Split(states,"/")[3],64)
-                        partitions[partition].allocated = allocated
-                        partitions[partition].idle = idle
-                        partitions[partition].other = other
-                        partitions[partition].total = total
-                }
-        }
-        // get list of pending jobs by partition name
-        list := strings.Split(string(PartitionsPendingJobsData()),"\n")
-        for _,partition := range list {
-		// accumulate the number of pending jobs
-		_,key := partitions[partition]
+// Accumulate the number of pending jobs by partition name
+func AddPartitionsPendingJobs(partitions map[string]*PartitionMetrics, jobs []Job) {
+	for _, job := range jobs {
+		if job.state != "PENDING" {
+			continue
+		}
+		_, key := partitions[job.partition]
 		if key {
-			partitions[partition].pending += 1
-                }
-        }
-
-
-        return partitions
+			partitions[job.partition].pending += 1
+		}
+	}
 }
 
 type PartitionsCollector struct {
-        allocated *prometheus.Desc
-        idle *prometheus.Desc
-        other *prometheus.Desc
-        pending *prometheus.Desc
-        total *prometheus.Desc
+	nodes     *NodesSnapshot
+	jobs      *JobsSnapshot
+	allocated *prometheus.Desc
+	idle      *prometheus.Desc
+	other     *prometheus.Desc
+	pending   *prometheus.Desc
+	total     *prometheus.Desc
 }
 
-func NewPartitionsCollector() *PartitionsCollector {
-        labels := []string{"partition"}
-        return &PartitionsCollector{
-                allocated: prometheus.NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels,nil),
-		idle: prometheus.NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels,nil),
-		other: prometheus.NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels,nil),
-		pending: prometheus.NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels,nil),
-		total: prometheus.NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels,nil),
-        }
+func NewPartitionsCollector(nodes *NodesSnapshot, jobs *JobsSnapshot) *PartitionsCollector {
+	labels := []string{"partition"}
+	return &PartitionsCollector{
+		nodes:     nodes,
+		jobs:      jobs,
+		allocated: prometheus.NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels, nil),
+		idle:      prometheus.NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels, nil),
+		other:     prometheus.NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels, nil),
+		pending:   prometheus.NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels, nil),
+		total:     prometheus.NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels, nil),
+	}
 }
 
 func (pc *PartitionsCollector) Describe(ch chan<- *prometheus.Desc) {
-        ch <- pc.allocated
-        ch <- pc.idle
-        ch <- pc.other
-        ch <- pc.pending
-        ch <- pc.total
+	ch <- pc.allocated
+	ch <- pc.idle
+	ch <- pc.other
+	ch <- pc.pending
+	ch <- pc.total
+}
+
+// Read the nodes and execute squeue again on the next update
+func (pc *PartitionsCollector) Reset() {
+	pc.nodes.Reset()
+	pc.jobs.Reset()
 }
 
-func (pc *PartitionsCollector) Collect(ch chan<- prometheus.Metric) {
-        pm := ParsePartitionsMetrics()
-        for p := range pm {
-                if pm[p].allocated > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.allocated, prometheus.GaugeValue, pm[p].allocated, p)
-                }
-                if pm[p].idle > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.idle, prometheus.GaugeValue, pm[p].idle, p)
-                }
-                if pm[p].other > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.other, prometheus.GaugeValue, pm[p].other, p)
-                }
-                if pm[p].pending > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.pending, prometheus.GaugeValue, pm[p].pending, p)
-                }
-                if pm[p].total > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.total, prometheus.GaugeValue, pm[p].total, p)
-                }
-        }
+func (pc *PartitionsCollector) Update(ch chan<- prometheus.Metric) error {
+	pm, err := pc.nodes.Partitions()
+	if err != nil {
+		return err
+	}
+	jobs, err := pc.jobs.Jobs()
+	if err != nil {
+		return err
+	}
+	pc.jobs.countParseErrors("partitions")
+	AddPartitionsPendingJobs(pm, jobs)
+	for p := range pm {
+		if pm[p].allocated > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.allocated, prometheus.GaugeValue, pm[p].allocated, p)
+		}
+		if pm[p].idle > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.idle, prometheus.GaugeValue, pm[p].idle, p)
+		}
+		if pm[p].other > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.other, prometheus.GaugeValue, pm[p].other, p)
+		}
+		if pm[p].pending > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.pending, prometheus.GaugeValue, pm[p].pending, p)
+		}
+		if pm[p].total > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.total, prometheus.GaugeValue, pm[p].total, p)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,195 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+)
+
+/*
+ * Returns the backend of the named target of the configuration, the
+ * settings apply unless set by the target. The metrics of the commands
+ * executed for the target are labeled with its name.
+ */
+func NewTargetBackend(settings *Settings, name string, target TargetConfig) (Backend, error) {
+	if target.Backend == "rest" {
+		rest := target.REST
+		if rest.APIVersion == "" {
+			rest.APIVersion = settings.REST.APIVersion
+		}
+		if rest.User == "" {
+			rest.User = settings.REST.User
+		}
+		if rest.TokenFile == "" {
+			rest.TokenFile = settings.REST.TokenFile
+		}
+		timeout := settings.REST.Timeout
+		if rest.Timeout != nil {
+			timeout = *rest.Timeout
+		}
+		return NewRESTBackend(rest.URL, rest.APIVersion, rest.User, rest.TokenFile, timeout) // from rest.go
+	}
+	var env []string
+	if target.SlurmConf != "" {
+		env = append(env, "SLURM_CONF="+target.SlurmConf)
+	}
+	return newCLIBackend(settings, name, target.Cluster, env) // from backend.go
+}
+
+/*
+ * The backend of a target, the version of Slurm and the collectors of
+ * every module probed, kept between probes so concurrent probes share
+ * their updates.
+ */
+type probeTarget struct {
+	backend    Backend
+	info       *SlurmInfo
+	collectors map[string]*SlurmCollector
+}
+
+/*
+ * The ProbeHandler serves /probe?target=<target>&module=<module> like
+ * the blackbox exporter. The collectors of the module are updated for
+ * the target on every request, like on scrapes of /metrics, and their
+ * metrics are gathered by a fresh registry, so one exporter serves many
+ * clusters. Without a module the enabled collectors are updated.
+ */
+type ProbeHandler struct {
+	targets    map[string]TargetConfig
+	modules    map[string][]string
+	collectors []string
+	setup      func(*SlurmCollector)
+	newBackend func(string, TargetConfig) (Backend, error)
+
+	mu    sync.Mutex
+	cache map[string]*probeTarget
+}
+
+/*
+ * The enabled collectors and the backends of the targets are those of the
+ * settings. The setup is applied to the collector of every probe, e.g. to
+ * set the label filters.
+ */
+func NewProbeHandler(targets map[string]TargetConfig, modules map[string][]string, settings *Settings, setup func(*SlurmCollector)) *ProbeHandler {
+	newBackend := func(name string, target TargetConfig) (Backend, error) {
+		return NewTargetBackend(settings, name, target)
+	}
+	return &ProbeHandler{
+		targets:    targets,
+		modules:    modules,
+		collectors: settings.Collectors,
+		setup:      setup,
+		newBackend: newBackend,
+		cache:      make(map[string]*probeTarget),
+	}
+}
+
+/*
+ * Returns the backend of the target, created on the first probe. The
+ * backend is created without holding the lock, since the cli backend
+ * executes sinfo --version, so a slow target does not block the probes
+ * of the other targets. If two probes create the backend at the same
+ * time, the backend of the first one is kept.
+ */
+func (ph *ProbeHandler) target(name string) (*probeTarget, error) {
+	ph.mu.Lock()
+	target, ok := ph.cache[name]
+	ph.mu.Unlock()
+	if ok {
+		return target, nil
+	}
+	config, ok := ph.targets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown target %s", name)
+	}
+	backend, err := ph.newBackend(name, config)
+	if err != nil {
+		return nil, err
+	}
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	if target, ok := ph.cache[name]; ok {
+		return target, nil
+	}
+	target = &probeTarget{
+		backend:    backend,
+		info:       NewSlurmInfo(backend),
+		collectors: make(map[string]*SlurmCollector),
+	}
+	ph.cache[name] = target
+	return target, nil
+}
+
+func (ph *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("target")
+	if name == "" {
+		http.Error(w, "Parameter target is missing", http.StatusBadRequest)
+		return
+	}
+	if _, ok := ph.targets[name]; !ok {
+		http.Error(w, fmt.Sprintf("Unknown target %s", name), http.StatusBadRequest)
+		return
+	}
+	module := r.URL.Query().Get("module")
+	names := ph.collectors
+	if module != "" {
+		var ok bool
+		if names, ok = ph.modules[module]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %s", module), http.StatusBadRequest)
+			return
+		}
+	}
+	target, err := ph.target(name)
+	if err != nil {
+		log.Errorf("Probe of %s failed: %s", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	collector, err := ph.collector(target, module, names)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector, target.info)
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// Returns the collector of the module of the target, created on the first probe
+func (ph *ProbeHandler) collector(target *probeTarget, module string, names []string) (*SlurmCollector, error) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	if collector, ok := target.collectors[module]; ok {
+		return collector, nil
+	}
+	collectors, err := NewCollectors(names, target.backend) // from collector.go
+	if err != nil {
+		return nil, err
+	}
+	collector := NewSlurmCollector(collectors)
+	collector.SetBackend(target.backend)
+	if ph.setup != nil {
+		ph.setup(collector)
+	}
+	target.collectors[module] = collector
+	return collector, nil
+}
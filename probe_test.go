@@ -0,0 +1,138 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, handler http.Handler, query string) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/probe?"+query, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestProbeHandler(t *testing.T) {
+	handler := NewProbeHandler(
+		map[string]TargetConfig{"alpha": {Cluster: "alpha"}},
+		map[string][]string{"cpus": {"cpus"}},
+		&Settings{Collectors: []string{"cpus", "nodes"}},
+		nil)
+	backends := 0
+	handler.newBackend = func(name string, target TargetConfig) (Backend, error) {
+		backends++
+		if target.Cluster != "alpha" {
+			t.Errorf("Unexpected target %+v", target)
+		}
+		return NewCLIBackend(testRunner{"sinfo -h -o %C": "test_data/sinfo_cpus.txt"}), nil
+	}
+	for i := 0; i < 2; i++ {
+		code, body := probe(t, handler, "target=alpha&module=cpus")
+		if code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", code, body)
+		}
+		if !strings.Contains(body, "slurm_cpus_total 6636") {
+			t.Errorf("Expected the CPUs of the target, got:\n%s", body)
+		}
+		// Only the collectors of the module are updated
+		if strings.Contains(body, `slurm_exporter_collector_success{collector="nodes"}`) {
+			t.Errorf("Expected the nodes collector to be skipped, got:\n%s", body)
+		}
+	}
+	if backends != 1 {
+		t.Errorf("Expected the backend of the target to be created once, got %d", backends)
+	}
+	// Without a module the enabled collectors are updated
+	if _, body := probe(t, handler, "target=alpha"); !strings.Contains(body, `slurm_exporter_collector_success{collector="nodes"} 0`) {
+		t.Errorf("Expected the nodes collector to be updated, got:\n%s", body)
+	}
+	for _, query := range []string{"", "target=beta", "target=alpha&module=gpus"} {
+		if code, _ := probe(t, handler, query); code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q, got %d", query, code)
+		}
+	}
+}
+
+func TestProbeSlowTarget(t *testing.T) {
+	handler := NewProbeHandler(
+		map[string]TargetConfig{"alpha": {Cluster: "alpha"}, "slow": {Cluster: "slow"}},
+		nil,
+		&Settings{Collectors: []string{"cpus"}},
+		nil)
+	release := make(chan struct{})
+	handler.newBackend = func(name string, target TargetConfig) (Backend, error) {
+		if target.Cluster == "slow" {
+			<-release
+		}
+		return NewCLIBackend(testRunner{"sinfo -h -o %C": "test_data/sinfo_cpus.txt"}), nil
+	}
+	done := make(chan int)
+	go func() {
+		code, _ := probe(t, handler, "target=slow")
+		done <- code
+	}()
+	// The probe of another target is not blocked by the slow target
+	probed := make(chan int)
+	go func() {
+		code, _ := probe(t, handler, "target=alpha")
+		probed <- code
+	}()
+	select {
+	case code := <-probed:
+		if code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The probe of alpha waited for the backend of the slow target")
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected status 200 for the slow target, got %d", code)
+	}
+}
+
+func TestProbeRESTTarget(t *testing.T) {
+	server := newTestRESTServer(t)
+	defer server.Close()
+	target := TargetConfig{Backend: "rest", REST: RESTConfig{URL: server.URL, User: "slurm", TokenFile: "test_data/rest/token"}}
+	settings := FlagSettings()
+	settings.Collectors = []string{"cpus"}
+	handler := NewProbeHandler(map[string]TargetConfig{"gamma": target}, nil, settings, nil)
+	code, body := probe(t, handler, "target=gamma")
+	if code != http.StatusOK || !strings.Contains(body, "slurm_cpus_total 160") {
+		t.Errorf("Expected the CPUs of the REST API, got %d:\n%s", code, body)
+	}
+}
+
+func TestNewTargetBackend(t *testing.T) {
+	settings := FlagSettings()
+	settings.Format = "text"
+	backend, err := NewTargetBackend(settings, "beta", TargetConfig{SlurmConf: "/etc/slurm-beta/slurm.conf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner, ok := backend.(*CLIBackend).runner.(*CommandRunner)
+	if !ok || len(runner.env) != 1 || runner.env[0] != "SLURM_CONF=/etc/slurm-beta/slurm.conf" {
+		t.Errorf("Expected the commands to be executed with SLURM_CONF, got %+v", backend.(*CLIBackend).runner)
+	}
+	if ok && runner.cluster != "beta" {
+		t.Errorf("Expected the metrics of the commands to be labeled with the target, got %q", runner.cluster)
+	}
+}
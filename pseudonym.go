@@ -0,0 +1,164 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	pseudonymizeKeyFile = flag.String(
+		"pseudonymize.key-file",
+		"",
+		"File containing the secret key of the pseudonyms replacing the values of the user label, user names are exported if not set.")
+	pseudonymizeMappingAuthFile = flag.String(
+		"pseudonymize.mapping.auth-file",
+		"",
+		"YAML file with the basic_auth_users allowed to look up the user of a pseudonym at /pseudonyms, the endpoint is disabled if not set.")
+)
+
+// The label replaced by the pseudonyms
+const pseudonymLabel = "user"
+
+/*
+ * The Pseudonymizer replaces the user names by their HMAC-SHA256 keyed
+ * with a secret, so the same user has the same pseudonym on every scrape
+ * but the name can not be recovered without the key. The users of the
+ * pseudonyms seen are kept for the mapping endpoint.
+ */
+type Pseudonymizer struct {
+	key []byte
+
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+func NewPseudonymizer(key []byte) (*Pseudonymizer, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty key")
+	}
+	return &Pseudonymizer{key: key, users: make(map[string]string)}, nil
+}
+
+// Reads the key from a file, surrounding white space is ignored
+func LoadPseudonymizer(path string) (*Pseudonymizer, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewPseudonymizer(bytes.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return p, nil
+}
+
+// Returns the pseudonym of a user, the first 16 hex digits of the HMAC
+func (p *Pseudonymizer) Pseudonym(user string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(user))
+	pseudonym := hex.EncodeToString(mac.Sum(nil))[:16]
+	p.mu.Lock()
+	p.users[pseudonym] = user
+	p.mu.Unlock()
+	return pseudonym
+}
+
+// Returns the user of a pseudonym seen before
+func (p *Pseudonymizer) User(pseudonym string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	user, ok := p.users[pseudonym]
+	return user, ok
+}
+
+// Replaces the value of the user label of the metric, if any
+func (p *Pseudonymizer) Metric(m prometheus.Metric) prometheus.Metric {
+	if p == nil {
+		return m
+	}
+	// The users aggregated by the cardinality limits are not a user, see cardinality.go
+	if _, ok := m.(otherMetric); ok {
+		return m
+	}
+	return &pseudonymMetric{Metric: m, pseudonymizer: p}
+}
+
+/*
+ * A metric with the pseudonym as value of the user label. The labels of
+ * a metric can only be read from its Write method, so the value is
+ * replaced there.
+ */
+type pseudonymMetric struct {
+	prometheus.Metric
+	pseudonymizer *Pseudonymizer
+}
+
+func (pm *pseudonymMetric) Write(out *dto.Metric) error {
+	if err := pm.Metric.Write(out); err != nil {
+		return err
+	}
+	for _, label := range out.Label {
+		if label.GetName() == pseudonymLabel {
+			pseudonym := pm.pseudonymizer.Pseudonym(label.GetValue())
+			label.Value = &pseudonym
+		}
+	}
+	return nil
+}
+
+// Serves the user of the pseudonym of the parameter pseudonym
+func (p *Pseudonymizer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pseudonym := r.URL.Query().Get("pseudonym")
+	if pseudonym == "" {
+		http.Error(w, "Parameter pseudonym is missing", http.StatusBadRequest)
+		return
+	}
+	user, ok := p.User(pseudonym)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown pseudonym %s", pseudonym), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, user)
+}
+
+/*
+ * Returns the mapping endpoint, requiring the basic_auth_users of the
+ * file in the format of the web configuration file.
+ */
+func PseudonymMappingHandler(p *Pseudonymizer, authFile string) (http.Handler, error) {
+	config, err := LoadWebServerConfig(authFile) // from web.go
+	if err != nil {
+		return nil, err
+	}
+	if len(config.BasicAuthUsers) == 0 {
+		return nil, fmt.Errorf("%s: no basic_auth_users", authFile)
+	}
+	return basicAuthHandler(config.BasicAuthUsers, p), nil
+}
@@ -0,0 +1,172 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPseudonym(t *testing.T) {
+	p, err := NewPseudonymizer([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pseudonym := p.Pseudonym("alice")
+	if len(pseudonym) != 16 || strings.Contains(pseudonym, "alice") {
+		t.Errorf("Unexpected pseudonym %s", pseudonym)
+	}
+	if p.Pseudonym("alice") != pseudonym || p.Pseudonym("bob") == pseudonym {
+		t.Errorf("Expected a stable pseudonym per user")
+	}
+	other, _ := NewPseudonymizer([]byte("other secret"))
+	if other.Pseudonym("alice") == pseudonym {
+		t.Errorf("Expected a different pseudonym with another key")
+	}
+	if user, ok := p.User(pseudonym); !ok || user != "alice" {
+		t.Errorf("Expected the user of the pseudonym, got %s", user)
+	}
+	if p.Pseudonym("other") == "other" {
+		t.Errorf("Expected a pseudonym for a user named other")
+	}
+	if _, err := NewPseudonymizer(nil); err == nil {
+		t.Error("Expected an error for an empty key")
+	}
+}
+
+func TestSlurmCollectorPseudonyms(t *testing.T) {
+	p, _ := NewPseudonymizer([]byte("secret"))
+	desc := prometheus.NewDesc("slurm_user_jobs_running", "Running jobs for user", []string{"user"}, nil)
+	collector := NewSlurmCollector(map[string]Collector{"users": &testCollector{
+		metrics: []prometheus.Metric{
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, "alice"),
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2, "root"),
+		},
+		desc: desc,
+	}})
+	filters := LabelFilters{"user": {Exclude: "root"}}
+	if err := filters.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	collector.SetLabelFilters(filters)
+	collector.SetPseudonymizer(p)
+	metrics := gatherByCollector(t, collector)["slurm_user_jobs_running"]
+	// The filters select by the user name
+	if len(metrics) != 1 {
+		t.Fatalf("Expected the series of a single user, got %v", metrics)
+	}
+	for _, m := range metrics {
+		if value := m.GetLabel()[0].GetValue(); value != p.Pseudonym("alice") {
+			t.Errorf("Expected the pseudonym of alice, got %s", value)
+		}
+	}
+}
+
+func TestPseudonymOtherUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pseudonyms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	squeue := filepath.Join(dir, "squeue.txt")
+	jobs := "1|hpc|other|RUNNING|4|main|None\n2|hpc|alice|RUNNING|8|main|None\n3|hpc|bob|RUNNING|2|main|None\n"
+	if err := ioutil.WriteFile(squeue, []byte(jobs), 0600); err != nil {
+		t.Fatal(err)
+	}
+	runner := testRunner{"squeue -a -r -h -o %A|%a|%u|%T|%C|%P|%r --states=all": squeue}
+	p, _ := NewPseudonymizer([]byte("secret"))
+	for _, c := range []struct {
+		limit    *CardinalityLimit
+		expected string
+	}{
+		// A user named other is replaced like any other user
+		{nil, fmt.Sprintf(`slurm_user_cpus_running{user="%s"} 8
+slurm_user_cpus_running{user="%s"} 2
+slurm_user_cpus_running{user="%s"} 4
+`, p.Pseudonym("alice"), p.Pseudonym("bob"), p.Pseudonym("other"))},
+		// The users aggregated by the cardinality limit are not
+		{&CardinalityLimit{TopN: 1, Other: true}, fmt.Sprintf(`slurm_user_cpus_running{user="%s"} 8
+slurm_user_cpus_running{user="other"} 6
+`, p.Pseudonym("alice"))},
+	} {
+		collector := NewSlurmCollector(map[string]Collector{"users": NewUsersCollector(NewJobsSnapshot(NewCLIBackend(runner)))})
+		collector.SetCardinalityLimits(CardinalityLimits{"users": c.limit})
+		collector.SetPseudonymizer(p)
+		expected := "# HELP slurm_user_cpus_running Running cpus for user\n# TYPE slurm_user_cpus_running gauge\n" + c.expected
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_user_cpus_running"); err != nil {
+			t.Errorf("Limit %+v: %s", c.limit, err)
+		}
+	}
+}
+
+func TestPseudonymMappingHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pseudonyms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authFile := filepath.Join(dir, "auth.yml")
+	if err := ioutil.WriteFile(authFile, []byte("basic_auth_users:\n  admin: "+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := NewPseudonymizer([]byte("secret"))
+	pseudonym := p.Pseudonym("alice")
+	handler, err := PseudonymMappingHandler(p, authFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for query, expected := range map[string]int{
+		"pseudonym=" + pseudonym:     http.StatusOK,
+		"pseudonym=0123456789abcdef": http.StatusNotFound,
+		"":                           http.StatusBadRequest,
+	} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/pseudonyms?"+query, nil)
+		request.SetBasicAuth("admin", "secret")
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != expected {
+			t.Errorf("Expected status %d for %q, got %d", expected, query, recorder.Code)
+		}
+		if expected == http.StatusOK && recorder.Body.String() != "alice\n" {
+			t.Errorf("Expected the user of the pseudonym, got %q", recorder.Body.String())
+		}
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/pseudonyms?pseudonym="+pseudonym, nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without authentication, got %d", recorder.Code)
+	}
+	// The endpoint requires users
+	empty := filepath.Join(dir, "empty.yml")
+	ioutil.WriteFile(empty, []byte("tls_server_config: {}\n"), 0600)
+	if _, err := PseudonymMappingHandler(p, empty); err == nil {
+		t.Error("Expected an error without basic_auth_users")
+	}
+}
@@ -0,0 +1,160 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	pushURL = flag.String(
+		"push.url",
+		"",
+		"URL of a Pushgateway to push the metrics to at every -push.interval.")
+	pushInterval = flag.Duration(
+		"push.interval",
+		time.Minute,
+		"Interval between pushes to the Pushgateway.")
+	pushJob = flag.String(
+		"push.job",
+		"slurm_exporter",
+		"Job label of the metrics pushed to the Pushgateway.")
+	pushGrouping = flag.String(
+		"push.grouping",
+		"",
+		"Comma-separated name=value pairs grouping the metrics pushed to the Pushgateway in addition to the job, instance defaults to the host name.")
+)
+
+/*
+ * Returns the grouping labels of a comma-separated list of name=value
+ * pairs. The instance label is set to the host name unless given.
+ */
+func ParseGrouping(grouping string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(grouping, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid grouping %q, expected name=value", pair)
+		}
+		if !model.LabelName(parts[0]).IsValid() || parts[0] == "job" {
+			return nil, fmt.Errorf("invalid grouping label %q", parts[0])
+		}
+		labels[parts[0]] = parts[1]
+	}
+	if _, ok := labels["instance"]; !ok {
+		if hostname, err := os.Hostname(); err == nil {
+			labels["instance"] = hostname
+		}
+	}
+	return labels, nil
+}
+
+/*
+ * The Pusher pushes the metrics of the gatherer to a Pushgateway. All
+ * metrics of the group are replaced on every push. The outcome of the
+ * pushes is exported by the metrics of the Pusher, a failed push is
+ * reported by the next successful one.
+ */
+type Pusher struct {
+	pusher      *push.Pusher
+	pushes      prometheus.Counter
+	failures    prometheus.Counter
+	duration    prometheus.Gauge
+	lastSuccess prometheus.Gauge
+}
+
+func NewPusher(url, job string, grouping map[string]string, gatherer prometheus.Gatherer, timeout time.Duration) *Pusher {
+	pusher := push.New(url, job).Gatherer(gatherer).Client(&http.Client{Timeout: timeout})
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	return &Pusher{
+		pusher: pusher,
+		pushes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "slurm_exporter_pushes_total",
+			Help: "Number of pushes to the Pushgateway",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "slurm_exporter_push_failures_total",
+			Help: "Number of failed pushes to the Pushgateway",
+		}),
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "slurm_exporter_push_duration_seconds",
+			Help: "Duration of the last push to the Pushgateway",
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "slurm_exporter_push_last_success_timestamp_seconds",
+			Help: "Unix timestamp of the last successful push to the Pushgateway",
+		}),
+	}
+}
+
+func (p *Pusher) Describe(ch chan<- *prometheus.Desc) {
+	p.pushes.Describe(ch)
+	p.failures.Describe(ch)
+	p.duration.Describe(ch)
+	p.lastSuccess.Describe(ch)
+}
+
+func (p *Pusher) Collect(ch chan<- prometheus.Metric) {
+	p.pushes.Collect(ch)
+	p.failures.Collect(ch)
+	p.duration.Collect(ch)
+	p.lastSuccess.Collect(ch)
+}
+
+// Gather the metrics and push them once
+func (p *Pusher) Push() error {
+	start := time.Now()
+	p.pushes.Inc()
+	err := p.pusher.Push()
+	p.duration.Set(time.Since(start).Seconds())
+	if err != nil {
+		p.failures.Inc()
+		return err
+	}
+	p.lastSuccess.SetToCurrentTime()
+	return nil
+}
+
+// Push the metrics in the background every interval
+func (p *Pusher) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := p.Push(); err != nil {
+				log.Errorf("Push to the Pushgateway failed: %s", err)
+			} else {
+				log.Debugf("Pushed the metrics to the Pushgateway")
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// A Pushgateway stand-in keeping the last push
+type testPushgateway struct {
+	status int
+	method string
+	path   string
+	body   string
+}
+
+func (tp *testPushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	tp.method, tp.path, tp.body = r.Method, r.URL.Path, string(body)
+	w.WriteHeader(tp.status)
+}
+
+func TestParseGrouping(t *testing.T) {
+	grouping, err := ParseGrouping("site=gsi,instance=head1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grouping) != 2 || grouping["site"] != "gsi" || grouping["instance"] != "head1" {
+		t.Errorf("Unexpected grouping %v", grouping)
+	}
+	// The instance defaults to the host name
+	if grouping, err := ParseGrouping(""); err != nil || grouping["instance"] == "" {
+		t.Errorf("Expected the host name as instance, got %v: %v", grouping, err)
+	}
+	for _, invalid := range []string{"site", "site=", "1site=gsi", "job=slurm"} {
+		if _, err := ParseGrouping(invalid); err == nil {
+			t.Errorf("Expected an error for grouping %q", invalid)
+		}
+	}
+}
+
+func TestPusher(t *testing.T) {
+	gateway := &testPushgateway{status: http.StatusOK}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewSlurmCollector(map[string]Collector{
+		"test": &testCollector{desc: prometheus.NewDesc("test_pushed", "Pushed collector", nil, nil)},
+	}))
+	pusher := NewPusher(server.URL, "slurm_exporter", map[string]string{"instance": "head1"}, registry, time.Second)
+	registry.MustRegister(pusher)
+
+	if err := pusher.Push(); err != nil {
+		t.Fatal(err)
+	}
+	// All metrics of the group are replaced
+	if gateway.method != http.MethodPut || gateway.path != "/metrics/job/slurm_exporter/instance/head1" {
+		t.Errorf("Unexpected push %s %s", gateway.method, gateway.path)
+	}
+	if !strings.Contains(gateway.body, "test_pushed") {
+		t.Errorf("Expected the metrics of the collectors in the push, got %q", gateway.body)
+	}
+
+	gateway.status = http.StatusInternalServerError
+	if err := pusher.Push(); err == nil {
+		t.Error("Expected an error of the failed push")
+	}
+	expected := `
+# HELP slurm_exporter_push_failures_total Number of failed pushes to the Pushgateway
+# TYPE slurm_exporter_push_failures_total counter
+slurm_exporter_push_failures_total 1
+# HELP slurm_exporter_pushes_total Number of pushes to the Pushgateway
+# TYPE slurm_exporter_pushes_total counter
+slurm_exporter_pushes_total 2
+`
+	if err := testutil.CollectAndCompare(pusher, strings.NewReader(expected), "slurm_exporter_pushes_total", "slurm_exporter_push_failures_total"); err != nil {
+		t.Error(err)
+	}
+	if v := testutil.ToFloat64(pusher.lastSuccess); v <= 0 {
+		t.Errorf("Expected the timestamp of the first push, got %v", v)
+	}
+}
@@ -17,10 +17,6 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
-	"log"
-	"os/exec"
-	"strings"
 )
 
 type QueueMetrics struct {
@@ -38,75 +34,58 @@ type QueueMetrics struct {
 	node_fail   float64
 }
 
-// Returns the scheduler metrics
-func QueueGetMetrics() *QueueMetrics {
-	return ParseQueueMetrics(QueueData())
+// Returns the queue metrics
+func QueueGetMetrics(jobs *JobsSnapshot) (*QueueMetrics, error) {
+	list, err := jobs.Jobs()
+	if err != nil {
+		return nil, err
+	}
+	jobs.countParseErrors("queue")
+	return ParseQueueMetrics(list), nil
 }
 
-func ParseQueueMetrics(input []byte) *QueueMetrics {
+func ParseQueueMetrics(jobs []Job) *QueueMetrics {
 	var qm QueueMetrics
-	lines := strings.Split(string(input), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, ",") {
-			splitted := strings.Split(line, ",")
-			state := splitted[1]
-			switch state {
-			case "PENDING":
-				qm.pending++
-				if len(splitted) > 2 && splitted[2] == "Dependency" {
-					qm.pending_dep++
-				}
-			case "RUNNING":
-				qm.running++
-			case "SUSPENDED":
-				qm.suspended++
-			case "CANCELLED":
-				qm.cancelled++
-			case "COMPLETING":
-				qm.completing++
-			case "COMPLETED":
-				qm.completed++
-			case "CONFIGURING":
-				qm.configuring++
-			case "FAILED":
-				qm.failed++
-			case "TIMEOUT":
-				qm.timeout++
-			case "PREEMPTED":
-				qm.preempted++
-			case "NODE_FAIL":
-				qm.node_fail++
+	for _, job := range jobs {
+		switch job.state {
+		case "PENDING":
+			qm.pending++
+			if job.reason == "Dependency" {
+				qm.pending_dep++
 			}
+		case "RUNNING":
+			qm.running++
+		case "SUSPENDED":
+			qm.suspended++
+		case "CANCELLED":
+			qm.cancelled++
+		case "COMPLETING":
+			qm.completing++
+		case "COMPLETED":
+			qm.completed++
+		case "CONFIGURING":
+			qm.configuring++
+		case "FAILED":
+			qm.failed++
+		case "TIMEOUT":
+			qm.timeout++
+		case "PREEMPTED":
+			qm.preempted++
+		case "NODE_FAIL":
+			qm.node_fail++
 		}
 	}
 	return &qm
 }
 
-// Execute the squeue command and return its output
-func QueueData() []byte {
-	cmd := exec.Command("squeue", "-a", "-r", "-h", "-o %A,%T,%r", "--states=all")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
-}
-
 /*
- * Implement the Prometheus Collector interface and feed the
+ * Implement the Collector interface (see collector.go) and feed the
  * Slurm queue metrics into it.
- * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
  */
 
-func NewQueueCollector() *QueueCollector {
+func NewQueueCollector(jobs *JobsSnapshot) *QueueCollector {
 	return &QueueCollector{
+		jobs:        jobs,
 		pending:     prometheus.NewDesc("slurm_queue_pending", "Pending jobs in queue", nil, nil),
 		pending_dep: prometheus.NewDesc("slurm_queue_pending_dependency", "Pending jobs because of dependency in queue", nil, nil),
 		running:     prometheus.NewDesc("slurm_queue_running", "Running jobs in the cluster", nil, nil),
@@ -123,6 +102,7 @@ func NewQueueCollector() *QueueCollector {
 }
 
 type QueueCollector struct {
+	jobs        *JobsSnapshot
 	pending     *prometheus.Desc
 	pending_dep *prometheus.Desc
 	running     *prometheus.Desc
@@ -152,8 +132,16 @@ func (qc *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- qc.node_fail
 }
 
-func (qc *QueueCollector) Collect(ch chan<- prometheus.Metric) {
-	qm := QueueGetMetrics()
+// Execute squeue again on the next update
+func (qc *QueueCollector) Reset() {
+	qc.jobs.Reset()
+}
+
+func (qc *QueueCollector) Update(ch chan<- prometheus.Metric) error {
+	qm, err := QueueGetMetrics(qc.jobs)
+	if err != nil {
+		return err
+	}
 	ch <- prometheus.MustNewConstMetric(qc.pending, prometheus.GaugeValue, qm.pending)
 	ch <- prometheus.MustNewConstMetric(qc.pending_dep, prometheus.GaugeValue, qm.pending_dep)
 	ch <- prometheus.MustNewConstMetric(qc.running, prometheus.GaugeValue, qm.running)
@@ -166,4 +154,5 @@ func (qc *QueueCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(qc.timeout, prometheus.GaugeValue, qm.timeout)
 	ch <- prometheus.MustNewConstMetric(qc.preempted, prometheus.GaugeValue, qm.preempted)
 	ch <- prometheus.MustNewConstMetric(qc.node_fail, prometheus.GaugeValue, qm.node_fail)
+	return nil
 }
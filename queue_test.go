@@ -18,7 +18,10 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestParseQueueMetrics(t *testing.T) {
@@ -28,9 +31,39 @@ func TestParseQueueMetrics(t *testing.T) {
 		t.Fatalf("Can not open test data: %v", err)
 	}
 	data, err := ioutil.ReadAll(file)
-	t.Logf("%+v", ParseQueueMetrics(data))
+	t.Logf("%+v", ParseQueueMetrics(ParseJobs(data)))
 }
 
 func TestQueueGetMetrics(t *testing.T) {
-	t.Logf("%+v", QueueGetMetrics())
+	metrics, err := QueueGetMetrics(NewJobsSnapshot(NewCLIBackend(newFlagCommandRunner())))
+	if err != nil {
+		t.Skipf("Can not execute squeue: %v", err)
+	}
+	t.Logf("%+v", metrics)
+}
+
+func TestQueueCollector(t *testing.T) {
+	runner := testRunner{"squeue -a -r -h -o %A|%a|%u|%T|%C|%P|%r --states=all": "test_data/squeue.txt"}
+	collector := NewSlurmCollector(map[string]Collector{"queue": NewQueueCollector(NewJobsSnapshot(NewCLIBackend(runner)))})
+	expected := `
+# HELP slurm_queue_pending Pending jobs in queue
+# TYPE slurm_queue_pending gauge
+slurm_queue_pending 4
+# HELP slurm_queue_pending_dependency Pending jobs because of dependency in queue
+# TYPE slurm_queue_pending_dependency gauge
+slurm_queue_pending_dependency 2
+# HELP slurm_queue_running Running jobs in the cluster
+# TYPE slurm_queue_running gauge
+slurm_queue_running 28
+# HELP slurm_queue_completing Completing jobs in the cluster
+# TYPE slurm_queue_completing gauge
+slurm_queue_completing 2
+# HELP slurm_queue_node_fail Number of jobs stopped due to node fail
+# TYPE slurm_queue_node_fail gauge
+slurm_queue_node_fail 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_queue_pending", "slurm_queue_pending_dependency", "slurm_queue_running", "slurm_queue_completing", "slurm_queue_node_fail"); err != nil {
+		t.Error(err)
+	}
 }
@@ -0,0 +1,238 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// A single execution of a Slurm command, saved as JSON file
+type Recording struct {
+	Command  string    `json:"command"`
+	Args     []string  `json:"args"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr"`
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// The command line of the recording, e.g. sinfo -h -o %C
+func (r *Recording) line() string {
+	return strings.Join(append([]string{r.Command}, r.Args...), " ")
+}
+
+// Implemented by runners returning the output on standard error and the exit code
+type outputRunner interface {
+	RunOutput(command string, args ...string) (*CommandOutput, error)
+}
+
+/*
+ * The RecordingRunner saves the output of every command executed by the
+ * runner to a file in a directory per scrape, named by the time of the
+ * scrape. The runner is reset before every update of the collectors,
+ * which starts a new scrape. Only the most recent scrapes are kept.
+ */
+type RecordingRunner struct {
+	runner Runner
+	dir    string
+	keep   int
+
+	mu     sync.Mutex
+	scrape string
+}
+
+// Numbers the recordings and scrapes of all runners, several commands may be executed at the same time
+var recordingSequence uint64
+
+// The directory of a scrape, e.g. 20211012T101500.000000000-000001
+var scrapeDir = regexp.MustCompile(`^\d{8}T\d{6}\.\d{9}-\d{6}$`)
+
+// Keeps the recordings of the last keep scrapes in the directory, all if keep is 0
+func NewRecordingRunner(runner Runner, dir string, keep int) (*RecordingRunner, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	rr := &RecordingRunner{runner: runner, dir: dir, keep: keep}
+	// The commands executed before the first update, e.g. sinfo --version
+	rr.Reset()
+	return rr, nil
+}
+
+// Saves the following recordings in the directory of a new scrape
+func (rr *RecordingRunner) Reset() {
+	sequence := atomic.AddUint64(&recordingSequence, 1)
+	rr.mu.Lock()
+	rr.scrape = fmt.Sprintf("%s-%06d", time.Now().UTC().Format("20060102T150405.000000000"), sequence)
+	rr.mu.Unlock()
+}
+
+func (rr *RecordingRunner) Run(command string, args ...string) ([]byte, error) {
+	recording := &Recording{Command: command, Args: args, Time: time.Now().UTC()}
+	var stdout []byte
+	var err error
+	if r, ok := rr.runner.(outputRunner); ok {
+		var out *CommandOutput
+		out, err = r.RunOutput(command, args...)
+		if out != nil {
+			stdout = out.Stdout
+			recording.Stderr = string(out.Stderr)
+			recording.ExitCode = out.ExitCode
+		}
+	} else {
+		stdout, err = rr.runner.Run(command, args...)
+	}
+	recording.Stdout = string(stdout)
+	if err != nil {
+		recording.Error = err.Error()
+		if recording.ExitCode == 0 {
+			recording.ExitCode = -1
+		}
+		stdout = nil
+	}
+	if werr := rr.save(recording); werr != nil {
+		log.Errorf("Can not record %s: %s", recording.line(), werr)
+	}
+	return stdout, err
+}
+
+func (rr *RecordingRunner) save(recording *Recording) error {
+	rr.mu.Lock()
+	dir := filepath.Join(rr.dir, rr.scrape)
+	rr.mu.Unlock()
+	// The directory of a scrape is created with its first recording
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.Mkdir(dir, 0750); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := rr.prune(); err != nil {
+			log.Errorf("Can not delete old recordings: %s", err)
+		}
+	}
+	sequence := atomic.AddUint64(&recordingSequence, 1)
+	name := fmt.Sprintf("%s-%06d-%s.json", recording.Time.Format("20060102T150405.000000000"), sequence, recording.Command)
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), data, 0640)
+}
+
+// Deletes the directories of the oldest scrapes, so that only the last scrapes are kept
+func (rr *RecordingRunner) prune() error {
+	if rr.keep <= 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(rr.dir)
+	if err != nil {
+		return err
+	}
+	scrapes := []string{}
+	for _, file := range files {
+		if file.IsDir() && scrapeDir.MatchString(file.Name()) {
+			scrapes = append(scrapes, file.Name())
+		}
+	}
+	// The names start with the time of the scrape
+	sort.Strings(scrapes)
+	for len(scrapes) > rr.keep {
+		if err := os.RemoveAll(filepath.Join(rr.dir, scrapes[0])); err != nil {
+			return err
+		}
+		scrapes = scrapes[1:]
+	}
+	return nil
+}
+
+/*
+ * The ReplayRunner returns the recordings of a directory and its scrape
+ * directories instead of executing the commands. The recordings of the
+ * same command line are returned in the order they were recorded,
+ * starting over after the last.
+ */
+type ReplayRunner struct {
+	mu         sync.Mutex
+	recordings map[string][]*Recording
+	next       map[string]int
+}
+
+func NewReplayRunner(dir string) (*ReplayRunner, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && filepath.Ext(path) == ".json" {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings in %s", dir)
+	}
+	// The names of the scrapes and the recordings start with their time
+	sort.Strings(files)
+	rr := &ReplayRunner{
+		recordings: make(map[string][]*Recording),
+		next:       make(map[string]int),
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		recording := &Recording{}
+		if err := json.Unmarshal(data, recording); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		if recording.Command == "" {
+			return nil, fmt.Errorf("%s: not a recording", file)
+		}
+		line := recording.line()
+		rr.recordings[line] = append(rr.recordings[line], recording)
+	}
+	return rr, nil
+}
+
+func (rr *ReplayRunner) Run(command string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{command}, args...), " ")
+	rr.mu.Lock()
+	recordings := rr.recordings[line]
+	if len(recordings) == 0 {
+		rr.mu.Unlock()
+		return nil, fmt.Errorf("no recording of %s", line)
+	}
+	recording := recordings[rr.next[line]%len(recordings)]
+	rr.next[line]++
+	rr.mu.Unlock()
+	if recording.Error != "" {
+		return nil, errors.New(recording.Error)
+	}
+	return []byte(recording.Stdout), nil
+}
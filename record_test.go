@@ -0,0 +1,136 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordingRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner, err := NewRecordingRunner(newFlagCommandRunner(), dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runner.Run("echo", "5725/877/34/6636"); err != nil || string(out) != "5725/877/34/6636\n" {
+		t.Fatalf("Unexpected output %q and error %v", out, err)
+	}
+	if _, err := runner.Run("sh", "-c", "echo failed >&2; exit 3"); err == nil {
+		t.Fatal("Expected an error of the failing command")
+	}
+
+	// The commands before the first reset are saved in the first scrape
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 recordings, got %v: %v", files, err)
+	}
+	data, err := ioutil.ReadFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recording Recording
+	if err := json.Unmarshal(data, &recording); err != nil {
+		t.Fatal(err)
+	}
+	if recording.Command != "sh" || recording.Stderr != "failed\n" || recording.ExitCode != 3 || recording.Error == "" {
+		t.Errorf("Unexpected recording %+v", recording)
+	}
+
+	// The recordings are replayed in the same order
+	replay, err := NewReplayRunner(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := replay.Run("echo", "5725/877/34/6636"); err != nil || string(out) != "5725/877/34/6636\n" {
+		t.Errorf("Unexpected replayed output %q and error %v", out, err)
+	}
+	if _, err := replay.Run("sh", "-c", "echo failed >&2; exit 3"); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("Expected the recorded error, got %v", err)
+	}
+	if _, err := replay.Run("sinfo"); err == nil {
+		t.Error("Expected an error for a command without recording")
+	}
+}
+
+func TestRecordingScrapes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner, err := NewRecordingRunner(testRunner{"sinfo -h -o %C": "test_data/sinfo_cpus.txt"}, dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewSlurmCollector(map[string]Collector{"cpus": NewCPUsCollector(NewNodesSnapshot(NewCLIBackend(runner)))})
+	collector.SetBackend(NewCLIBackend(runner))
+	scrapes := []string{}
+	for scrape := 1; scrape <= 3; scrape++ {
+		gatherByCollector(t, collector)
+		files, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scrapes = append(scrapes, filepath.Dir(files[len(files)-1]))
+	}
+	// Only the last two scrapes are kept, each in a directory of its own
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected the recordings of 2 scrapes, got %v: %v", files, err)
+	}
+	if filepath.Dir(files[0]) != scrapes[1] || filepath.Dir(files[1]) != scrapes[2] {
+		t.Errorf("Expected the recordings of the last scrapes %v, got %v", scrapes[1:], files)
+	}
+	if _, err := NewReplayRunner(dir); err != nil {
+		t.Errorf("Can not replay the scrapes: %s", err)
+	}
+}
+
+func TestReplayRunner(t *testing.T) {
+	replay, err := NewReplayRunner("test_data/recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := NewCLIBackend(replay)
+	// The recordings of a command line are replayed in turn
+	for i, expected := range []float64{6636, 0, 6636} {
+		cpus, err := backend.CPUs()
+		if expected == 0 {
+			if err == nil {
+				t.Errorf("Expected the recorded error in replay %d", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cpus.total != expected {
+			t.Errorf("Expected %v CPUs in replay %d, got %v", expected, i, cpus.total)
+		}
+	}
+	if _, err := NewReplayRunner("test_data/rest"); err == nil {
+		t.Error("Expected an error for a directory of other JSON files")
+	}
+}
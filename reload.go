@@ -0,0 +1,230 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+var shutdownTimeout = flag.Duration(
+	"web.shutdown-timeout",
+	30*time.Second,
+	"Time to wait for the requests in flight on shutdown, the Slurm commands still running are killed afterwards.")
+
+var webEnableLifecycle = flag.Bool(
+	"web.enable-lifecycle",
+	false,
+	"Reload the configuration on POST requests to /-/reload, like Prometheus. The endpoint is only protected by the basic authentication of -web.config.file.")
+
+// The collectors and handlers of all clusters, built from the configuration on every reload
+type exporterState struct {
+	registry   *prometheus.Registry
+	collectors []*SlurmCollector
+	landing    http.Handler
+	ready      http.Handler
+	probe      http.Handler
+}
+
+/*
+ * The Exporter builds the collectors of all clusters from the flags and
+ * the configuration file, and rebuilds them on reload. Every load builds
+ * new Settings (see settings.go) instead of changing the flags, so the
+ * collectors of the last load keep their settings until replaced. The
+ * metrics of the collectors are gathered from a registry replaced on
+ * every reload, the handlers serve the state of the last successful
+ * reload.
+ */
+type Exporter struct {
+	explicit      map[string]bool
+	pseudonymizer *Pseudonymizer
+	polling       bool
+
+	reload sync.Mutex
+	mu     sync.RWMutex
+	state  *exporterState
+}
+
+/*
+ * The flags given on the command line take precedence over the file on
+ * every reload. Without polling the collectors are only updated on
+ * scrapes, regardless of -cache.interval.
+ */
+func NewExporter(explicit map[string]bool, pseudonymizer *Pseudonymizer, polling bool) *Exporter {
+	return &Exporter{explicit: explicit, pseudonymizer: pseudonymizer, polling: polling}
+}
+
+// Read the configuration file and replace the collectors, on errors the collectors of the last load are kept
+func (e *Exporter) Load() error {
+	e.reload.Lock()
+	defer e.reload.Unlock()
+	config := &Config{}
+	if *configFile != "" {
+		var err error
+		if config, err = LoadConfig(*configFile); err != nil { // from config.go
+			return err
+		}
+	}
+	settings, err := NewSettings(config, e.explicit) // from settings.go
+	if err != nil {
+		return err
+	}
+	state, err := e.build(config, settings)
+	if err != nil {
+		return err
+	}
+	if e.polling && settings.Interval > 0 {
+		e.mu.RLock()
+		reload := e.state != nil
+		e.mu.RUnlock()
+		// The collectors of the last load are served until the new ones have results
+		if reload {
+			refresh(state.collectors)
+		}
+		log.Infof("Updating collectors every %s", settings.Interval)
+		for _, collector := range state.collectors {
+			collector.StartPolling(settings.Interval)
+		}
+	}
+	e.mu.Lock()
+	old := e.state
+	e.state = state
+	e.mu.Unlock()
+	if old != nil {
+		for _, collector := range old.collectors {
+			collector.StopPolling()
+		}
+	}
+	return nil
+}
+
+// Updates the collectors of all clusters in parallel
+func refresh(collectors []*SlurmCollector) {
+	wg := sync.WaitGroup{}
+	wg.Add(len(collectors))
+	for _, collector := range collectors {
+		go func(collector *SlurmCollector) {
+			defer wg.Done()
+			collector.Refresh()
+		}(collector)
+	}
+	wg.Wait()
+}
+
+func (e *Exporter) build(config *Config, settings *Settings) (*exporterState, error) {
+	// Applies the settings of all collectors
+	setup := func(collector *SlurmCollector) {
+		collector.SetLabelFilters(config.LabelFilters)
+		collector.SetCardinalityLimits(config.Cardinality)
+		collector.SetPseudonymizer(e.pseudonymizer)
+		collector.SetMinInterval(settings.MinInterval)
+		collector.SetMaxAges(settings.MaxAges)
+	}
+	names := settings.Collectors
+	log.Infof("Enabled collectors with %s backend: %s", settings.Backend, strings.Join(names, ", "))
+	clusters := settings.Clusters
+	if len(clusters) == 0 {
+		// The local cluster, its metrics are not labeled
+		clusters = []string{""}
+	}
+	state := &exporterState{registry: prometheus.NewRegistry()}
+	backends := []Backend{}
+	landing := []landingCluster{}
+	for _, cluster := range clusters {
+		// All collectors of a cluster read their data from the same backend
+		backend, err := NewBackend(settings, cluster) // from backend.go
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+		collectors, err := NewCollectors(names, backend)
+		if err != nil {
+			return nil, err
+		}
+		collector := NewSlurmCollector(collectors)
+		collector.SetBackend(backend)
+		setup(collector)
+		state.collectors = append(state.collectors, collector)
+		info := NewSlurmInfo(backend) // from version.go
+		landing = append(landing, landingCluster{Name: cluster, info: info})
+		if err := ClusterRegisterer(state.registry, cluster).Register(collector); err != nil {
+			return nil, err
+		}
+		if err := ClusterRegisterer(state.registry, cluster).Register(info); err != nil {
+			return nil, err
+		}
+	}
+	state.landing = landingHandler(names, landing) // from landing.go
+	state.ready = readyHandler(backends)           // from health.go
+	// Collects from the targets of the configuration file
+	state.probe = NewProbeHandler(config.Targets, config.Modules, settings, setup) // from probe.go
+	return state, nil
+}
+
+// Gather the metrics of the collectors of the last load
+func (e *Exporter) Gather() ([]*dto.MetricFamily, error) {
+	e.mu.RLock()
+	registry := e.state.registry
+	e.mu.RUnlock()
+	return registry.Gather()
+}
+
+// Returns a handler serving the handler of the last load
+func (e *Exporter) handler(get func(*exporterState) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mu.RLock()
+		handler := get(e.state)
+		e.mu.RUnlock()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (e *Exporter) LandingHandler() http.Handler {
+	return e.handler(func(s *exporterState) http.Handler { return s.landing })
+}
+
+func (e *Exporter) ReadyHandler() http.Handler {
+	return e.handler(func(s *exporterState) http.Handler { return s.ready })
+}
+
+func (e *Exporter) ProbeHandler() http.Handler {
+	return e.handler(func(s *exporterState) http.Handler { return s.probe })
+}
+
+// Reloads the configuration on POST requests, like /-/reload of Prometheus
+func (e *Exporter) ReloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := e.Load(); err != nil {
+			log.Errorf("Reload failed: %s", err)
+			http.Error(w, fmt.Sprintf("Reload failed: %s", err), http.StatusInternalServerError)
+			return
+		}
+		log.Info("Reloaded the configuration")
+	})
+}
@@ -0,0 +1,170 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// Writes the configuration file of the exporter
+func writeTestConfig(t *testing.T, path, config string) {
+	base := "commands:\n  format: text\n  replay_dir: test_data/recordings\n"
+	if err := ioutil.WriteFile(path, []byte(base+config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the collectors gathered with their enabled state
+func gatheredCollectors(t *testing.T, e *Exporter) map[string]float64 {
+	families, err := e.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "slurm_exporter_collector_enabled" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			enabled[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	return enabled
+}
+
+func TestExporterReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	defer func(path string) { *configFile = path }(*configFile)
+	*configFile = file.Name()
+
+	writeTestConfig(t, file.Name(), "collectors:\n  gpus: false\n")
+	exporter := NewExporter(map[string]bool{}, nil, false)
+	if err := exporter.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if enabled := gatheredCollectors(t, exporter); enabled["gpus"] != 0 || enabled["users"] != 1 {
+		t.Errorf("Unexpected collectors %v", enabled)
+	}
+
+	// Settings removed from the file are reset to their defaults
+	writeTestConfig(t, file.Name(), "collectors:\n  users: false\n")
+	recorder := httptest.NewRecorder()
+	exporter.ReloadHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/-/reload", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if enabled := gatheredCollectors(t, exporter); enabled["gpus"] != 1 || enabled["users"] != 0 {
+		t.Errorf("Unexpected collectors after reload %v", enabled)
+	}
+
+	// An invalid file keeps the collectors of the last load
+	// The REST backend does not support clusters
+	writeTestConfig(t, file.Name(), "backend: rest\nrest:\n  url: http://slurmrestd:6820\nclusters: [alpha]\n")
+	recorder = httptest.NewRecorder()
+	exporter.ReloadHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/-/reload", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", recorder.Code)
+	}
+	if enabled := gatheredCollectors(t, exporter); enabled["users"] != 0 {
+		t.Errorf("Unexpected collectors after a failed reload %v", enabled)
+	}
+	// The flags are never changed by a load
+	if settings := FlagSettings(); settings.Backend != "cli" || settings.REST.URL != "" || len(settings.Clusters) != 0 || len(settings.Collectors) != len(collectorFactories) {
+		t.Errorf("Expected the flags of the command line, got %+v", settings)
+	}
+
+	recorder = httptest.NewRecorder()
+	exporter.ReloadHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/-/reload", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for GET, got %d", recorder.Code)
+	}
+}
+
+// Run with -race, the collectors polling in the background execute commands during the reloads
+func TestExporterReloadPolling(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	defer func(path string) { *configFile = path }(*configFile)
+	*configFile = file.Name()
+
+	// The commands are executed with the prefix true, they succeed without output
+	config := "commands:\n  format: text\n  prefix: [true]\ncache_interval: 1ms\ncache_max_age: 1m\n"
+	if err := ioutil.WriteFile(file.Name(), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewExporter(map[string]bool{}, nil, true)
+	for i := 0; i < 20; i++ {
+		if err := exporter.Load(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := exporter.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exporter.mu.RLock()
+	defer exporter.mu.RUnlock()
+	for _, collector := range exporter.state.collectors {
+		collector.StopPolling()
+	}
+}
+
+func TestExporterReloadResults(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	defer func(path string) { *configFile = path }(*configFile)
+	*configFile = file.Name()
+
+	writeTestConfig(t, file.Name(), "cache_interval: 1h\n")
+	exporter := NewExporter(map[string]bool{}, nil, true)
+	for load := 1; load <= 2; load++ {
+		if err := exporter.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, collector := range exporter.state.collectors {
+			collector.StopPolling()
+		}
+	}()
+	// The collectors of a reload are updated before they are served
+	families, err := exporter.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "slurm_exporter_collector_success" && len(family.GetMetric()) > 0 {
+			return
+		}
+	}
+	t.Error("Expected the results of the reloaded collectors")
+}
@@ -0,0 +1,487 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * The RESTBackend reads the jobs, nodes, partitions and scheduler statistics
+ * from the slurmrestd REST API, authenticating with a JWT token. The token
+ * is read on every request, so that it can be renewed without a restart.
+ * https://slurm.schedmd.com/rest.html
+ */
+type RESTBackend struct {
+	url       string
+	version   string
+	user      string
+	tokenFile string
+	client    *http.Client
+}
+
+func NewRESTBackend(url, version, user, tokenFile string, timeout time.Duration) (*RESTBackend, error) {
+	if url == "" {
+		return nil, errors.New("the rest backend requires the URL of slurmrestd")
+	}
+	return &RESTBackend{
+		url:       strings.TrimSuffix(url, "/"),
+		version:   version,
+		user:      user,
+		tokenFile: tokenFile,
+		client:    &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Returns the JWT token from the token file or the environment
+func (b *RESTBackend) token() (string, error) {
+	if b.tokenFile != "" {
+		token, err := ioutil.ReadFile(b.tokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+	if token := os.Getenv("SLURM_JWT"); token != "" {
+		return token, nil
+	}
+	return "", errors.New("no JWT token for slurmrestd, set -rest.token-file or $SLURM_JWT")
+}
+
+// Query an endpoint of slurmrestd and decode the response into v
+func (b *RESTBackend) get(endpoint string, v restResult) error {
+	url := fmt.Sprintf("%s/slurm/%s/%s", b.url, b.version, endpoint)
+	token, err := b.token()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if b.user != "" {
+		req.Header.Set("X-SLURM-USER-NAME", b.user)
+	}
+	req.Header.Set("X-SLURM-USER-TOKEN", token)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %s", url, err)
+	}
+	return v.err()
+}
+
+func (b *RESTBackend) nodes() ([]restNode, error) {
+	var resp restNodesResponse
+	if err := b.get("nodes", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Nodes, nil
+}
+
+// Implements the nodesReader interface, see nodes.go
+func (b *RESTBackend) readNodes() (*nodesData, error) {
+	nodes, err := b.nodes()
+	if err != nil {
+		return nil, err
+	}
+	return &nodesData{nodes: nodes}, nil
+}
+
+func (b *RESTBackend) gpus(data *nodesData) (*GPUsMetrics, error) {
+	return restGPUsMetrics(data.nodes), nil
+}
+
+// The partitions are only read if needed, the nodes list the partitions they belong to
+func (b *RESTBackend) partitions(data *nodesData) (map[string]*PartitionMetrics, error) {
+	var resp restPartitionsResponse
+	if err := b.get("partitions", &resp); err != nil {
+		return nil, err
+	}
+	return restPartitionsMetrics(resp.Partitions, data.nodes), nil
+}
+
+func (b *RESTBackend) CPUs() (*CPUsMetrics, error) {
+	return NewNodesSnapshot(b).CPUs()
+}
+
+func (b *RESTBackend) GPUs() (*GPUsMetrics, error) {
+	return NewNodesSnapshot(b).GPUs()
+}
+
+func (b *RESTBackend) Nodes() (*NodesMetrics, error) {
+	return NewNodesSnapshot(b).Nodes()
+}
+
+func (b *RESTBackend) Partitions() (map[string]*PartitionMetrics, error) {
+	return NewNodesSnapshot(b).Partitions()
+}
+
+func (b *RESTBackend) Jobs() ([]Job, error) {
+	var resp restJobsResponse
+	if err := b.get("jobs", &resp); err != nil {
+		return nil, err
+	}
+	return restJobs(resp.Jobs), nil
+}
+
+func (b *RESTBackend) Scheduler() (*SchedulerMetrics, error) {
+	var resp restDiagResponse
+	if err := b.get("diag", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Statistics.metrics(), nil
+}
+
+func (b *RESTBackend) Controllers() ([]ControllerStatus, error) {
+	var resp restPingResponse
+	if err := b.get("ping", &resp); err != nil {
+		return nil, err
+	}
+	controllers := []ControllerStatus{}
+	for _, p := range resp.Pings {
+		controllers = append(controllers, ControllerStatus{
+			host: p.Hostname,
+			role: p.Mode,
+			up:   strings.ToUpper(p.Ping) == "UP",
+		})
+	}
+	return controllers, nil
+}
+
+// The version of slurmrestd is returned with every response
+func (b *RESTBackend) Version() (string, error) {
+	var resp restPingResponse
+	if err := b.get("ping", &resp); err != nil {
+		return "", err
+	}
+	if resp.Meta.Slurm.Release == "" {
+		return "", errors.New("slurmrestd did not return its version")
+	}
+	return resp.Meta.Slurm.Release, nil
+}
+
+// The shares of the accounts are not available from the slurmrestd API
+func (b *RESTBackend) FairShare() (map[string]*FairShareMetrics, error) {
+	return nil, fmt.Errorf("sshare: %s", errNotSupported)
+}
+
+/*
+ * The types below decode the responses of the slurmrestd API. Newer API
+ * versions wrap numbers into an object and return states as a list, both
+ * formats are accepted.
+ */
+
+type restResult interface {
+	err() error
+}
+
+type restError struct {
+	Error       string `json:"error"`
+	Description string `json:"description"`
+}
+
+type restErrors struct {
+	Errors []restError `json:"errors"`
+}
+
+func (r *restErrors) err() error {
+	messages := []string{}
+	for _, e := range r.Errors {
+		message := strings.TrimSpace(e.Error + " " + e.Description)
+		if message != "" {
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, ", "))
+	}
+	return nil
+}
+
+type restMeta struct {
+	Slurm struct {
+		Release string `json:"release"`
+	} `json:"Slurm"`
+}
+
+type restNumber float64
+
+func (n *restNumber) UnmarshalJSON(data []byte) error {
+	var number float64
+	if err := json.Unmarshal(data, &number); err == nil {
+		*n = restNumber(number)
+		return nil
+	}
+	var wrapped struct {
+		Number float64 `json:"number"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return err
+	}
+	*n = restNumber(wrapped.Number)
+	return nil
+}
+
+type restStrings []string
+
+func (s *restStrings) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = restStrings{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*s = restStrings(list)
+	return nil
+}
+
+type restJobsResponse struct {
+	restErrors
+	Jobs []restJob `json:"jobs"`
+}
+
+type restJob struct {
+	JobID       restNumber  `json:"job_id"`
+	Account     string      `json:"account"`
+	UserName    string      `json:"user_name"`
+	JobState    restStrings `json:"job_state"`
+	CPUs        restNumber  `json:"cpus"`
+	Partition   string      `json:"partition"`
+	StateReason string      `json:"state_reason"`
+}
+
+// Returns the job as it would have been listed by squeue
+func (j restJob) job() Job {
+	state := ""
+	if len(j.JobState) > 0 {
+		state = j.JobState[0]
+	}
+	return Job{
+		id:        strconv.FormatFloat(float64(j.JobID), 'f', -1, 64),
+		account:   j.Account,
+		user:      j.UserName,
+		state:     strings.ToUpper(state),
+		cpus:      float64(j.CPUs),
+		partition: j.Partition,
+		reason:    j.StateReason,
+	}
+}
+
+func restJobs(list []restJob) []Job {
+	jobs := []Job{}
+	for _, j := range list {
+		jobs = append(jobs, j.job())
+	}
+	return jobs
+}
+
+type restNodesResponse struct {
+	restErrors
+	Nodes []restNode `json:"nodes"`
+}
+
+type restNode struct {
+	Name       string      `json:"name"`
+	State      restStrings `json:"state"`
+	StateFlags restStrings `json:"state_flags"`
+	CPUs       restNumber  `json:"cpus"`
+	AllocCPUs  restNumber  `json:"alloc_cpus"`
+	Partitions []string    `json:"partitions"`
+	Gres       string      `json:"gres"`
+	GresUsed   string      `json:"gres_used"`
+}
+
+// Returns the state of the node as printed by sinfo
+func (n restNode) state() string {
+	flags := make(map[string]bool)
+	for _, s := range append(n.State, n.StateFlags...) {
+		flags[strings.ToUpper(s)] = true
+	}
+	switch {
+	case flags["DOWN"]:
+		return "down"
+	case flags["DRAIN"]:
+		return "drain"
+	case flags["FAIL"]:
+		return "fail"
+	case flags["COMPLETING"]:
+		return "comp"
+	case flags["MAINTENANCE"] || flags["MAINT"]:
+		return "maint"
+	case flags["RESERVED"]:
+		return "resv"
+	case flags["ERROR"]:
+		return "err"
+	case flags["ALLOCATED"]:
+		return "alloc"
+	case flags["MIXED"]:
+		return "mix"
+	case flags["IDLE"]:
+		return "idle"
+	}
+	if len(n.State) > 0 {
+		return strings.ToLower(n.State[0])
+	}
+	return ""
+}
+
+// Accumulate the CPUs of the node like sinfo does for the %C format
+func (n restNode) addCPUs(alloc, idle, other, total *float64) {
+	cpus := float64(n.CPUs)
+	allocated := float64(n.AllocCPUs)
+	*alloc += allocated
+	*total += cpus
+	switch n.state() {
+	case "down", "drain", "fail", "err":
+		*other += cpus - allocated
+	default:
+		*idle += cpus - allocated
+	}
+}
+
+func restCPUsMetrics(nodes []restNode) *CPUsMetrics {
+	var cm CPUsMetrics
+	for _, node := range nodes {
+		node.addCPUs(&cm.alloc, &cm.idle, &cm.other, &cm.total)
+	}
+	return &cm
+}
+
+func restGPUsMetrics(nodes []restNode) *GPUsMetrics {
+	var gm GPUsMetrics
+	for _, node := range nodes {
+		gm.total += ParseGresGPUs(node.Gres)
+		gm.alloc += ParseGresGPUs(node.GresUsed)
+	}
+	gm.idle = gm.total - gm.alloc
+	gm.utilization = gm.alloc / gm.total
+	return &gm
+}
+
+func restNodesMetrics(nodes []restNode) *NodesMetrics {
+	var nm NodesMetrics
+	for _, node := range nodes {
+		nm.add(node.state(), 1)
+	}
+	return &nm
+}
+
+func restPartitionsMetrics(names []restPartition, nodes []restNode) map[string]*PartitionMetrics {
+	partitions := make(map[string]*PartitionMetrics)
+	for _, p := range names {
+		partitions[p.Name] = &PartitionMetrics{0, 0, 0, 0, 0}
+	}
+	for _, node := range nodes {
+		for _, name := range node.Partitions {
+			if p, ok := partitions[name]; ok {
+				node.addCPUs(&p.allocated, &p.idle, &p.other, &p.total)
+			}
+		}
+	}
+	return partitions
+}
+
+// Strip the socket or index information, e.g. gpu:tesla:2(IDX:0,1)
+var gresDetails = regexp.MustCompile(`\([^)]*\)`)
+
+// Returns the number of GPUs in a GRES string, e.g. gpu:tesla:4,mps:100
+func ParseGresGPUs(gres string) float64 {
+	var gpus float64
+	for _, entry := range strings.Split(gresDetails.ReplaceAllString(gres, ""), ",") {
+		fields := strings.Split(strings.TrimSpace(entry), ":")
+		if len(fields) < 2 || fields[0] != "gpu" {
+			continue
+		}
+		gpus += parseFloat("gpus", fields[len(fields)-1])
+	}
+	return gpus
+}
+
+type restPartitionsResponse struct {
+	restErrors
+	Partitions []restPartition `json:"partitions"`
+}
+
+type restPartition struct {
+	Name string `json:"name"`
+}
+
+type restPingResponse struct {
+	restErrors
+	Meta  restMeta `json:"meta"`
+	Pings []struct {
+		Hostname string `json:"hostname"`
+		Ping     string `json:"ping"`
+		Mode     string `json:"mode"`
+	} `json:"pings"`
+}
+
+type restDiagResponse struct {
+	restErrors
+	Statistics restStatistics `json:"statistics"`
+}
+
+type restStatistics struct {
+	ServerThreadCount      restNumber `json:"server_thread_count"`
+	AgentQueueSize         restNumber `json:"agent_queue_size"`
+	DBDAgentQueueSize      restNumber `json:"dbd_agent_queue_size"`
+	ScheduleCycleLast      restNumber `json:"schedule_cycle_last"`
+	ScheduleCycleMean      restNumber `json:"schedule_cycle_mean"`
+	ScheduleCyclePerMinute restNumber `json:"schedule_cycle_per_minute"`
+	BfCycleLast            restNumber `json:"bf_cycle_last"`
+	BfCycleMean            restNumber `json:"bf_cycle_mean"`
+	BfDepthMean            restNumber `json:"bf_depth_mean"`
+	BfBackfilledJobs       restNumber `json:"bf_backfilled_jobs"`
+	BfLastBackfilledJobs   restNumber `json:"bf_last_backfilled_jobs"`
+	BfBackfilledHetJobs    restNumber `json:"bf_backfilled_het_jobs"`
+}
+
+// Returns the statistics as they would have been printed by sdiag
+func (s restStatistics) metrics() *SchedulerMetrics {
+	return &SchedulerMetrics{
+		threads:                           float64(s.ServerThreadCount),
+		queue_size:                        float64(s.AgentQueueSize),
+		dbd_queue_size:                    float64(s.DBDAgentQueueSize),
+		last_cycle:                        float64(s.ScheduleCycleLast),
+		mean_cycle:                        float64(s.ScheduleCycleMean),
+		cycle_per_minute:                  float64(s.ScheduleCyclePerMinute),
+		backfill_last_cycle:               float64(s.BfCycleLast),
+		backfill_mean_cycle:               float64(s.BfCycleMean),
+		backfill_depth_mean:               float64(s.BfDepthMean),
+		total_backfilled_jobs_since_start: float64(s.BfBackfilledJobs),
+		total_backfilled_jobs_since_cycle: float64(s.BfLastBackfilledJobs),
+		total_backfilled_heterogeneous:    float64(s.BfBackfilledHetJobs),
+	}
+}
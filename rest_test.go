@@ -0,0 +1,173 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Serves the recorded responses of slurmrestd in test_data/rest
+func newTestRESTServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-SLURM-USER-NAME") != "slurm" || r.Header.Get("X-SLURM-USER-TOKEN") != "secret" {
+			http.Error(w, "Authentication failure", http.StatusUnauthorized)
+			return
+		}
+		endpoint := strings.TrimPrefix(r.URL.Path, "/slurm/v0.0.37/")
+		data, err := ioutil.ReadFile(filepath.Join("test_data/rest", endpoint+".json"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+}
+
+func newTestRESTBackend(t *testing.T, url string) *RESTBackend {
+	backend, err := NewRESTBackend(url, "v0.0.37", "slurm", "test_data/rest/token", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestRESTBackend(t *testing.T) {
+	server := newTestRESTServer(t)
+	defer server.Close()
+	backend := newTestRESTBackend(t, server.URL)
+
+	cpus, err := backend.CPUs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cpus != (CPUsMetrics{alloc: 56, idle: 56, other: 48, total: 160}) {
+		t.Errorf("Unexpected CPUs %+v", cpus)
+	}
+	nodes, err := backend.Nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *nodes != (NodesMetrics{alloc: 1, comp: 1, down: 1, drain: 1, idle: 1, mix: 1}) {
+		t.Errorf("Unexpected nodes %+v", nodes)
+	}
+	gpus, err := backend.GPUs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gpus.alloc != 6 || gpus.idle != 2 || gpus.total != 8 || gpus.utilization != 0.75 {
+		t.Errorf("Unexpected GPUs %+v", gpus)
+	}
+	partitions, err := backend.Partitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 2 ||
+		*partitions["main"] != (PartitionMetrics{allocated: 48, idle: 48, other: 32, total: 128}) ||
+		*partitions["debug"] != (PartitionMetrics{allocated: 8, idle: 40, other: 16, total: 64}) {
+		t.Errorf("Unexpected partitions %+v", partitions)
+	}
+	jobs, err := backend.Jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Job{id: "1003", account: "bio", user: "carol", state: "PENDING", cpus: 4, partition: "main", reason: "Dependency"}
+	if len(jobs) != 5 || jobs[2] != expected {
+		t.Errorf("Unexpected jobs %+v", jobs)
+	}
+	scheduler, err := backend.Scheduler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheduler.threads != 3 || scheduler.last_cycle != 97209 || scheduler.total_backfilled_jobs_since_start != 111544 {
+		t.Errorf("Unexpected scheduler statistics %+v", scheduler)
+	}
+	if _, err := backend.FairShare(); err == nil {
+		t.Error("Expected the fairshare data to be unsupported")
+	}
+}
+
+func TestRESTBackendErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slurm/v0.0.37/jobs" {
+			w.Write([]byte(`{"errors": [{"error": "Unable to query jobs", "errno": 1}], "jobs": []}`))
+			return
+		}
+		http.Error(w, "Authentication failure", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	backend := newTestRESTBackend(t, server.URL)
+
+	if _, err := backend.Jobs(); err == nil || !strings.Contains(err.Error(), "Unable to query jobs") {
+		t.Errorf("Expected the error of slurmrestd, got %v", err)
+	}
+	if _, err := backend.Nodes(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the HTTP status as error, got %v", err)
+	}
+}
+
+func TestParseGresGPUs(t *testing.T) {
+	for gres, expected := range map[string]float64{
+		"":                                0,
+		"gpu:4":                           4,
+		"gpu:tesla:2(IDX:0-1)":            2,
+		"gpu:tesla:2(S:0),gpu:k80:1(S:1)": 3,
+		"mps:100,gpu:a100:8(S:0-1),bandwidth:lustre:4G": 8,
+	} {
+		if gpus := ParseGresGPUs(gres); gpus != expected {
+			t.Errorf("Expected %v GPUs in %q, got %v", expected, gres, gpus)
+		}
+	}
+	before := testutil.ToFloat64(parseErrorsTotal.WithLabelValues("gpus"))
+	if gpus := ParseGresGPUs("gpu:tesla:2,gpu:k80:N/A"); gpus != 2 {
+		t.Errorf("Expected the GPUs which can be parsed, got %v", gpus)
+	}
+	if v := testutil.ToFloat64(parseErrorsTotal.WithLabelValues("gpus")) - before; v != 1 {
+		t.Errorf("Expected 1 parse error of gpus, got %v", v)
+	}
+}
+
+func TestRESTCollectors(t *testing.T) {
+	server := newTestRESTServer(t)
+	defer server.Close()
+	collectors, err := NewCollectors([]string{"nodes", "partitions", "queue"}, newTestRESTBackend(t, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewSlurmCollector(collectors)
+	expected := `
+# HELP slurm_nodes_drain Drain nodes
+# TYPE slurm_nodes_drain gauge
+slurm_nodes_drain 1
+# HELP slurm_partition_jobs_pending Pending jobs for partition
+# TYPE slurm_partition_jobs_pending gauge
+slurm_partition_jobs_pending{partition="main"} 2
+# HELP slurm_queue_pending_dependency Pending jobs because of dependency in queue
+# TYPE slurm_queue_pending_dependency gauge
+slurm_queue_pending_dependency 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_nodes_drain", "slurm_partition_jobs_pending", "slurm_queue_pending_dependency"); err != nil {
+		t.Error(err)
+	}
+}
@@ -18,7 +18,10 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestSchedulerMetrics(t *testing.T) {
@@ -32,5 +35,29 @@ func TestSchedulerMetrics(t *testing.T) {
 }
 
 func TestSchedulerGetMetrics(t *testing.T) {
-	t.Logf("%+v", SchedulerGetMetrics())
+	metrics, err := SchedulerGetMetrics(newFlagCommandRunner())
+	if err != nil {
+		t.Skipf("Can not execute sdiag: %v", err)
+	}
+	t.Logf("%+v", metrics)
+}
+
+func TestSchedulerCollector(t *testing.T) {
+	runner := testRunner{"sdiag": "test_data/sdiag.txt"}
+	collector := NewSlurmCollector(map[string]Collector{"scheduler": NewSchedulerCollector(NewCLIBackend(runner))})
+	expected := `
+# HELP slurm_scheduler_threads Information provided by the Slurm sdiag command, number of scheduler threads 
+# TYPE slurm_scheduler_threads gauge
+slurm_scheduler_threads 3
+# HELP slurm_scheduler_last_cycle Information provided by the Slurm sdiag command, scheduler last cycle time in (microseconds)
+# TYPE slurm_scheduler_last_cycle gauge
+slurm_scheduler_last_cycle 97209
+# HELP slurm_scheduler_backfill_last_cycle Information provided by the Slurm sdiag command, scheduler backfill last cycle time in (microseconds)
+# TYPE slurm_scheduler_backfill_last_cycle gauge
+slurm_scheduler_backfill_last_cycle 1.94289e+06
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_scheduler_threads", "slurm_scheduler_last_cycle", "slurm_scheduler_backfill_last_cycle"); err != nil {
+		t.Error(err)
+	}
 }
@@ -0,0 +1,236 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * The Settings of the collectors and of the Slurm commands, from the flags
+ * and the configuration file. Every load of the configuration builds new
+ * Settings and passes them to the collectors and the runners it creates,
+ * the flags themselves are never changed. The updates running during a
+ * reload keep the settings they were started with.
+ */
+type Settings struct {
+	Backend     string
+	Format      string
+	Collectors  []string
+	Clusters    []string
+	Commands    *CommandSettings
+	RecordDir   string
+	RecordKeep  int
+	ReplayDir   string
+	Interval    time.Duration
+	MinInterval time.Duration
+	// The maximum age of the metrics of every collector, see -cache.max-age
+	MaxAges map[string]time.Duration
+	REST    RESTSettings
+
+	// The values of the flags resolved into the fields above
+	clusters   string
+	prefix     string
+	maxAge     time.Duration
+	commands   map[string]*commandFlags
+	collectors map[string]*collectorFlags
+}
+
+// The settings of the REST backend, see rest.go
+type RESTSettings struct {
+	URL        string
+	APIVersion string
+	User       string
+	TokenFile  string
+	Timeout    time.Duration
+}
+
+// The flags of a single Slurm command, overriding the flags of all commands
+type commandFlags struct {
+	timeout time.Duration
+	path    string
+	env     envFlag
+}
+
+/*
+ * Every collector can be enabled with -collector.<name> and disabled with
+ * -no-collector.<name>, all collectors are enabled by default.
+ */
+type collectorFlags struct {
+	enabled  bool
+	disabled bool
+	maxAge   time.Duration
+}
+
+// The flags of the settings on the command line, the flags only read on startup are defined where read
+func init() {
+	defineSettings(flag.CommandLine)
+}
+
+/*
+ * Defines the flags of all settings on the flag set, the values of the
+ * flags are stored in the returned settings. The flags of the command line
+ * are defined once on startup, every load defines them again on a flag
+ * set of its own.
+ */
+func defineSettings(fs *flag.FlagSet) *Settings {
+	s := &Settings{
+		Commands:   &CommandSettings{},
+		commands:   make(map[string]*commandFlags),
+		collectors: make(map[string]*collectorFlags),
+	}
+	fs.StringVar(&s.Backend, "backend", "cli",
+		"Data source of the collectors, either \"cli\" to execute the Slurm commands or \"rest\" to query slurmrestd.")
+	fs.StringVar(&s.Format, "cli.format", "auto",
+		"Output format of the Slurm commands parsed by the cli backend, either \"text\", \"json\" or \"auto\" to use JSON if supported by the installed Slurm version.")
+	fs.StringVar(&s.clusters, "cluster", "",
+		"Comma separated list of Slurm clusters to collect the metrics from, the metrics are labeled with the cluster. Collects from the local cluster without a label if not set.")
+	fs.DurationVar(&s.Commands.Timeout, "command.timeout", 30*time.Second,
+		"Timeout for the execution of a Slurm command, 0 disables the timeout.")
+	fs.StringVar(&s.prefix, "command.prefix", "",
+		"Space-separated command line prefixed to every Slurm command, e.g. \"sudo -u slurm\" or \"ssh headnode\".")
+	fs.BoolVar(&s.Commands.Quote, "command.quote", false,
+		"Quote the Slurm command and its arguments for a shell after -command.prefix, for prefixes passing the command line to a shell like ssh.")
+	fs.Var((*envFlag)(&s.Commands.Env), "command.env",
+		"Comma-separated NAME=value pairs added to the environment of every Slurm command, e.g. SLURM_CONF=/etc/slurm/slurm.conf.")
+	for command := range slurmCommands {
+		cf := &commandFlags{}
+		s.commands[command] = cf
+		fs.DurationVar(&cf.timeout, "command."+command+".timeout", 0,
+			fmt.Sprintf("Timeout for the execution of %s, overrides -command.timeout if set.", command))
+		fs.StringVar(&cf.path, "command."+command+".path", "",
+			fmt.Sprintf("Path of %s, looked up in $PATH if not set.", command))
+		fs.Var(&cf.env, "command."+command+".env",
+			fmt.Sprintf("Comma-separated NAME=value pairs added to the environment of %s, in addition to -command.env.", command))
+	}
+	fs.StringVar(&s.RecordDir, "record.dir", "",
+		"Save the output of every Slurm command executed to a file in this directory.")
+	fs.IntVar(&s.RecordKeep, "record.keep", 100,
+		"Number of scrapes kept in -record.dir, the recordings of older scrapes are deleted. 0 keeps all scrapes.")
+	fs.StringVar(&s.ReplayDir, "replay.dir", "",
+		"Serve the output of the Slurm commands from the recordings in this directory instead of executing them.")
+	fs.DurationVar(&s.Interval, "cache.interval", 0,
+		"Update the collectors in the background at this interval and serve the metrics from the last update, 0 updates the collectors on every scrape.")
+	fs.DurationVar(&s.MinInterval, "cache.min-interval", 0,
+		"Minimum interval between two updates of the collectors on scrapes, scrapes within the interval are served from the last update.")
+	fs.DurationVar(&s.maxAge, "cache.max-age", 0,
+		"Serve the metrics of the last successful update of a failed collector for up to this age, 0 drops the metrics on failure.")
+	for name := range collectorFactories {
+		cf := &collectorFlags{}
+		s.collectors[name] = cf
+		fs.BoolVar(&cf.enabled, "collector."+name, true, fmt.Sprintf("Enable the %s collector.", name))
+		fs.BoolVar(&cf.disabled, "no-collector."+name, false, fmt.Sprintf("Disable the %s collector.", name))
+		fs.DurationVar(&cf.maxAge, "collector."+name+".max-age", 0,
+			fmt.Sprintf("Serve the metrics of the last successful update of the %s collector for up to this age, overrides -cache.max-age if set.", name))
+	}
+	fs.StringVar(&s.REST.URL, "rest.url", "",
+		"URL of slurmrestd used by the rest backend, e.g. http://localhost:6820.")
+	fs.StringVar(&s.REST.APIVersion, "rest.api-version", "v0.0.37",
+		"Version of the slurmrestd API.")
+	fs.StringVar(&s.REST.User, "rest.user", "",
+		"User name sent to slurmrestd with the JWT token.")
+	fs.StringVar(&s.REST.TokenFile, "rest.token-file", "",
+		"File containing the JWT token for slurmrestd, the token is read from $SLURM_JWT if not set.")
+	fs.DurationVar(&s.REST.Timeout, "rest.timeout", 30*time.Second,
+		"Timeout for a request to slurmrestd.")
+	return s
+}
+
+/*
+ * Returns the settings of the configuration and the flags, the flags
+ * given on the command line take precedence over the file. The settings
+ * neither given on the command line nor in the file have their default.
+ */
+func NewSettings(config *Config, explicit map[string]bool) (*Settings, error) {
+	values := config.flags()
+	for name := range explicit {
+		f := flag.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("unknown flag %s", name)
+		}
+		values[name] = f.Value.String()
+	}
+	return newSettings(values)
+}
+
+// Returns the settings of the flags as currently set, without a configuration file
+func FlagSettings() *Settings {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	// The values of the flags are valid
+	settings, _ := newSettings(values)
+	return settings
+}
+
+/*
+ * Returns the settings with the values of the flags by name, parsed by a
+ * flag set of their own. The flags only read on startup are skipped.
+ */
+func newSettings(values map[string]string) (*Settings, error) {
+	fs := flag.NewFlagSet("settings", flag.ContinueOnError)
+	s := defineSettings(fs)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			if flag.Lookup(name) != nil {
+				continue
+			}
+			return nil, fmt.Errorf("unknown flag %s", name)
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	s.resolve()
+	return s, nil
+}
+
+// Sets the fields of the settings resolved from the values of the flags
+func (s *Settings) resolve() {
+	s.Clusters = parseClusters(s.clusters) // from cluster.go
+	s.Commands.Prefix = strings.Fields(s.prefix)
+	s.Commands.Timeouts = make(map[string]time.Duration)
+	s.Commands.Paths = make(map[string]string)
+	s.Commands.Envs = make(map[string][]string)
+	for command, cf := range s.commands {
+		s.Commands.Timeouts[command] = cf.timeout
+		s.Commands.Paths[command] = cf.path
+		s.Commands.Envs[command] = cf.env
+	}
+	s.Collectors = []string{}
+	s.MaxAges = make(map[string]time.Duration)
+	for name, cf := range s.collectors {
+		if cf.enabled && !cf.disabled {
+			s.Collectors = append(s.Collectors, name)
+		}
+		// The maximum age of a collector overrides -cache.max-age if set
+		s.MaxAges[name] = s.maxAge
+		if cf.maxAge > 0 {
+			s.MaxAges[name] = cf.maxAge
+		}
+	}
+	sort.Strings(s.Collectors)
+}
@@ -16,71 +16,65 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
-        "strings"
-        "strconv"
-        "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
 )
 
-func FairShareData() []byte {
-        cmd := exec.Command( "sshare", "-n", "-P", "-o", "account,fairshare" )
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
-        }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
-        }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
-        }
-        return out
+func FairShareData(runner Runner) ([]byte, error) {
+	return runner.Run("sshare", "-n", "-P", "-o", "account,fairshare")
 }
 
 type FairShareMetrics struct {
-        fairshare float64
+	fairshare float64
 }
 
-func ParseFairShareMetrics() map[string]*FairShareMetrics {
-        accounts := make(map[string]*FairShareMetrics)
-        lines := strings.Split(string(FairShareData()), "\n")
-        for _, line := range lines {
-                if ! strings.HasPrefix(line,"  ") {
-                        if strings.Contains(line,"|") {
-                                account := strings.Trim(strings.Split(line,"|")[0]," ")
-                                _,key := accounts[account]
-                                if !key {
-                                        accounts[account] = &FairShareMetrics{0}
-                                }
-                                fairshare,_ := strconv.ParseFloat(strings.Split(line,"|")[1],64)
-                                accounts[account].fairshare = fairshare
-                        }
-                }
-        }
-        return accounts
+func ParseFairShareMetrics(runner Runner) (map[string]*FairShareMetrics, error) {
+	accounts := make(map[string]*FairShareMetrics)
+	data, err := FairShareData(runner)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "  ") {
+			if strings.Contains(line, "|") {
+				account := strings.Trim(strings.Split(line, "|")[0], " ")
+				_, key := accounts[account]
+				if !key {
+					accounts[account] = &FairShareMetrics{0}
+				}
+				fairshare := parseFloat("fairshare", strings.Split(line, "|")[1])
+				accounts[account].fairshare = fairshare
+			}
+		}
+	}
+	return accounts, nil
 }
 
 type FairShareCollector struct {
-        fairshare *prometheus.Desc
+	backend   Backend
+	fairshare *prometheus.Desc
 }
 
-func NewFairShareCollector() *FairShareCollector {
-        labels := []string{"account"}
-        return &FairShareCollector{
-                fairshare: prometheus.NewDesc("slurm_account_fairshare","FairShare for account" , labels,nil),
-        }
+func NewFairShareCollector(backend Backend) *FairShareCollector {
+	labels := []string{"account"}
+	return &FairShareCollector{
+		backend:   backend,
+		fairshare: prometheus.NewDesc("slurm_account_fairshare", "FairShare for account", labels, nil),
+	}
 }
 
 func (fsc *FairShareCollector) Describe(ch chan<- *prometheus.Desc) {
-        ch <- fsc.fairshare
+	ch <- fsc.fairshare
 }
 
-func (fsc *FairShareCollector) Collect(ch chan<- prometheus.Metric) {
-        fsm := ParseFairShareMetrics()
-        for f := range fsm {
-                ch <- prometheus.MustNewConstMetric(fsc.fairshare, prometheus.GaugeValue, fsm[f].fairshare, f)
-        }
+func (fsc *FairShareCollector) Update(ch chan<- prometheus.Metric) error {
+	fsm, err := fsc.backend.FairShare()
+	if err != nil {
+		return err
+	}
+	for f := range fsm {
+		ch <- prometheus.MustNewConstMetric(fsc.fairshare, prometheus.GaugeValue, fsm[f].fairshare, f)
+	}
+	return nil
 }
@@ -0,0 +1,65 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var outputTextfile = flag.String(
+	"output.textfile",
+	"",
+	"Update all enabled collectors once, write the metrics to this file for the textfile collector of node_exporter and exit.")
+
+/*
+ * Write the metrics gathered to a file in the text exposition format. The
+ * metrics are written to a temporary file in the same directory, which is
+ * renamed once complete, so node_exporter never reads a partial file.
+ */
+func WriteTextfile(gatherer prometheus.Gatherer, path string) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	// node_exporter only reads files ending with .prom
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	encoder := expfmt.NewEncoder(tmp, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			tmp.Close()
+			return fmt.Errorf("can not encode %s: %s", family.GetName(), err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// TempFile creates the file readable by the owner only
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,88 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "slurm.prom")
+	if err := ioutil.WriteFile(path, []byte("# previous run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewSlurmCollector(map[string]Collector{
+		"test": &testCollector{desc: prometheus.NewDesc("test_textfile", "Textfile collector", nil, nil)},
+	}))
+	if err := WriteTextfile(registry, path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"# TYPE test_textfile gauge\ntest_textfile 1\n", `slurm_exporter_collector_success{collector="test"} 1`} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %q in the textfile, got:\n%s", expected, data)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected a textfile readable by node_exporter, got %v", info.Mode())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected the temporary file to be renamed, got %d files", len(files))
+	}
+}
+
+func TestWriteTextfileFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "slurm.prom")
+	if err := ioutil.WriteFile(path, []byte("# previous run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The same metric sent twice fails the gathering
+	desc := prometheus.NewDesc("test_duplicate", "Duplicate metric", nil, nil)
+	metric := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewSlurmCollector(map[string]Collector{
+		"test": &testCollector{desc: desc, metrics: []prometheus.Metric{metric, metric}},
+	}))
+	if err := WriteTextfile(registry, path); err == nil {
+		t.Error("Expected an error for inconsistent metrics")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "# previous run\n" {
+		t.Errorf("Expected the textfile of the previous run to be kept, got:\n%s", data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected the temporary file to be removed, got %d files", len(files))
+	}
+}
@@ -16,107 +16,106 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
-        "strings"
-        "strconv"
-        "regexp"
-        "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+	"strings"
 )
 
-func UsersData() []byte {
-        cmd := exec.Command("squeue","-a","-r","-h","-o %A|%u|%T|%C")
-        stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+// The same metrics as for an account, see accounts.go
+type UserJobMetrics = JobMetrics
+
+func ParseUsersMetrics(jobs []Job) map[string]*UserJobMetrics {
+	users := make(map[string]*UserJobMetrics)
+	pending := regexp.MustCompile(`^pending`)
+	running := regexp.MustCompile(`^running`)
+	suspended := regexp.MustCompile(`^suspended`)
+	for _, job := range jobs {
+		user := job.user
+		_, key := users[user]
+		if !key {
+			users[user] = &UserJobMetrics{0, 0, 0, 0}
+		}
+		state := strings.ToLower(job.state)
+		switch {
+		case pending.MatchString(state) == true:
+			users[user].pending++
+		case running.MatchString(state) == true:
+			users[user].running++
+			users[user].running_cpus += job.cpus
+		case suspended.MatchString(state) == true:
+			users[user].suspended++
+		}
 	}
-	return out
+	return users
 }
 
-type UserJobMetrics struct {
-        pending float64
-        running float64
-        running_cpus float64
-        suspended float64
+type UsersCollector struct {
+	jobs         *JobsSnapshot
+	limit        *CardinalityLimit
+	pending      *prometheus.Desc
+	running      *prometheus.Desc
+	running_cpus *prometheus.Desc
+	suspended    *prometheus.Desc
 }
 
-func ParseUsersMetrics(input []byte) map[string]*UserJobMetrics {
-        users := make(map[string]*UserJobMetrics)
-        lines := strings.Split(string(input), "\n")
-        for _, line := range lines {
-                if strings.Contains(line,"|") {
-                        user := strings.Split(line,"|")[1]
-                        _,key := users[user]
-                        if !key {
-                                users[user] = &UserJobMetrics{0,0,0,0}
-                        }
-                        state := strings.Split(line,"|")[2]
-                        state = strings.ToLower(state)
-                        cpus,_ := strconv.ParseFloat(strings.Split(line,"|")[3],64)
-                        pending := regexp.MustCompile(`^pending`)
-                        running := regexp.MustCompile(`^running`)
-                        suspended := regexp.MustCompile(`^suspended`)
-                        switch {
-                        case pending.MatchString(state) == true:
-                                users[user].pending++
-                        case running.MatchString(state) == true:
-                                users[user].running++
-                                users[user].running_cpus += cpus
-                        case suspended.MatchString(state) == true:
-                                users[user].suspended++
-                        }
-                }
-        }
-        return users
+func NewUsersCollector(jobs *JobsSnapshot) *UsersCollector {
+	labels := []string{"user"}
+	return &UsersCollector{
+		jobs:         jobs,
+		pending:      prometheus.NewDesc("slurm_user_jobs_pending", "Pending jobs for user", labels, nil),
+		running:      prometheus.NewDesc("slurm_user_jobs_running", "Running jobs for user", labels, nil),
+		running_cpus: prometheus.NewDesc("slurm_user_cpus_running", "Running cpus for user", labels, nil),
+		suspended:    prometheus.NewDesc("slurm_user_jobs_suspended", "Suspended jobs for user", labels, nil),
+	}
 }
 
-type UsersCollector struct {
-        pending *prometheus.Desc
-        running *prometheus.Desc
-        running_cpus *prometheus.Desc
-        suspended *prometheus.Desc
+func (uc *UsersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- uc.pending
+	ch <- uc.running
+	ch <- uc.running_cpus
+	ch <- uc.suspended
 }
 
-func NewUsersCollector() *UsersCollector {
-        labels := []string{"user"}
-        return &UsersCollector {
-                pending: prometheus.NewDesc("slurm_user_jobs_pending", "Pending jobs for user", labels, nil), 
-                running: prometheus.NewDesc("slurm_user_jobs_running", "Running jobs for user", labels, nil),
-                running_cpus: prometheus.NewDesc("slurm_user_cpus_running", "Running cpus for user", labels, nil),
-                suspended: prometheus.NewDesc("slurm_user_jobs_suspended", "Suspended jobs for user", labels, nil),
-        }
+// Limit the series to the users selected, see cardinality.go
+func (uc *UsersCollector) SetCardinalityLimit(limit *CardinalityLimit) {
+	uc.limit = limit
 }
 
-func (uc *UsersCollector) Describe(ch chan<- *prometheus.Desc) {
-        ch <- uc.pending
-        ch <- uc.running
-        ch <- uc.running_cpus
-        ch <- uc.suspended
+// Execute squeue again on the next update
+func (uc *UsersCollector) Reset() {
+	uc.jobs.Reset()
 }
 
-func (uc *UsersCollector) Collect(ch chan<- prometheus.Metric) {
-        um := ParseUsersMetrics(UsersData())
-        for u := range um {
-                if um[u].pending > 0 {
-                        ch <- prometheus.MustNewConstMetric(uc.pending, prometheus.GaugeValue, um[u].pending, u)
-                }
-                if um[u].running > 0 {
-                        ch <- prometheus.MustNewConstMetric(uc.running, prometheus.GaugeValue, um[u].running, u)
-                }
-                if um[u].running_cpus > 0 {
-                        ch <- prometheus.MustNewConstMetric(uc.running_cpus, prometheus.GaugeValue, um[u].running_cpus, u)
-                }
-                if um[u].suspended > 0 {
-                        ch <- prometheus.MustNewConstMetric(uc.suspended, prometheus.GaugeValue, um[u].suspended, u)
-                }
-        }
+func (uc *UsersCollector) Update(ch chan<- prometheus.Metric) error {
+	jobs, err := uc.jobs.Jobs()
+	if err != nil {
+		return err
+	}
+	uc.jobs.countParseErrors("users")
+	countCPUsParseErrors("users", jobs)
+	um, dropped := uc.limit.Apply(ParseUsersMetrics(jobs))
+	seriesDroppedTotal.WithLabelValues("users").Add(float64(dropped))
+	aggregated := uc.limit.Aggregated(dropped)
+	for u := range um {
+		send := func(desc *prometheus.Desc, value float64) {
+			var m prometheus.Metric = prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, u)
+			if aggregated && u == otherBucket {
+				m = otherMetric{m}
+			}
+			ch <- m
+		}
+		if um[u].pending > 0 {
+			send(uc.pending, um[u].pending)
+		}
+		if um[u].running > 0 {
+			send(uc.running, um[u].running)
+		}
+		if um[u].running_cpus > 0 {
+			send(uc.running_cpus, um[u].running_cpus)
+		}
+		if um[u].suspended > 0 {
+			send(uc.suspended, um[u].suspended)
+		}
+	}
+	return nil
 }
-
@@ -0,0 +1,91 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var printVersion = flag.Bool(
+	"version",
+	false,
+	"Print the version of the exporter and exit.")
+
+// Execute sinfo to read the version of Slurm
+func SlurmVersionData(runner Runner) ([]byte, error) {
+	return runner.Run("sinfo", "--version")
+}
+
+// e.g. slurm 21.08.8-2
+var slurmVersion = regexp.MustCompile(`(?m)^slurm (\d+)\.(\d+)\S*`)
+
+// Returns the version, the major and the minor release from the output of sinfo --version
+func ParseSlurmVersion(input []byte) (string, string, string, error) {
+	match := slurmVersion.FindSubmatch(input)
+	if match == nil {
+		return "", "", "", fmt.Errorf("unknown Slurm version %q", input)
+	}
+	return string(match[0][len("slurm "):]), string(match[1]), string(match[2]), nil
+}
+
+/*
+ * The SlurmInfo detects the version of Slurm from the backend and exports
+ * it as the slurm_info metric. The version is only detected once, unless
+ * the detection failed.
+ */
+type SlurmInfo struct {
+	backend Backend
+	info    *prometheus.Desc
+
+	mu      sync.Mutex
+	version string
+}
+
+func NewSlurmInfo(backend Backend) *SlurmInfo {
+	return &SlurmInfo{
+		backend: backend,
+		info:    prometheus.NewDesc("slurm_info", "Version of Slurm", []string{"version"}, nil),
+	}
+}
+
+// Returns the version of Slurm, empty if it could not be detected
+func (si *SlurmInfo) Version() string {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if si.version == "" {
+		version, err := si.backend.Version()
+		if err != nil {
+			return ""
+		}
+		si.version = version
+	}
+	return si.version
+}
+
+func (si *SlurmInfo) Describe(ch chan<- *prometheus.Desc) {
+	ch <- si.info
+}
+
+func (si *SlurmInfo) Collect(ch chan<- prometheus.Metric) {
+	if version := si.Version(); version != "" {
+		ch <- prometheus.MustNewConstMetric(si.info, prometheus.GaugeValue, 1, version)
+	}
+}
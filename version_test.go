@@ -0,0 +1,58 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSlurmVersion(t *testing.T) {
+	version, major, minor, err := ParseSlurmVersion([]byte("slurm 22.05.8-1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "22.05.8-1" || major != "22" || minor != "05" {
+		t.Errorf("Unexpected version %s, major %s and minor %s", version, major, minor)
+	}
+	if _, _, _, err := ParseSlurmVersion([]byte("sinfo: invalid option")); err == nil {
+		t.Error("Expected an error for an unknown version")
+	}
+}
+
+func TestSlurmInfo(t *testing.T) {
+	info := NewSlurmInfo(NewCLIBackend(testRunner{"sinfo --version": "test_data/sinfo_version.txt"}))
+	expected := `
+# HELP slurm_info Version of Slurm
+# TYPE slurm_info gauge
+slurm_info{version="21.08.8"} 1
+`
+	if err := testutil.CollectAndCompare(info, strings.NewReader(expected), "slurm_info"); err != nil {
+		t.Error(err)
+	}
+	// The version of slurmrestd
+	server := newTestRESTServer(t)
+	defer server.Close()
+	if version := NewSlurmInfo(newTestRESTBackend(t, server.URL)).Version(); version != "21.08.8" {
+		t.Errorf("Unexpected version of slurmrestd %s", version)
+	}
+	// Nothing is exported if the version is unknown
+	if err := testutil.CollectAndCompare(NewSlurmInfo(NewCLIBackend(testRunner{})), strings.NewReader(""), "slurm_info"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,242 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+var webConfigFile = flag.String(
+	"web.config.file",
+	"",
+	"Path of the YAML file configuring TLS and basic authentication of the HTTP server.")
+
+/*
+ * The WebServerConfig is read from the file given with -web.config.file,
+ * in the format of the web configuration of the Prometheus exporters.
+ * https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md
+ */
+type WebServerConfig struct {
+	TLSServerConfig TLSServerConfig   `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+}
+
+type TLSServerConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// Read and validate the web configuration file
+func LoadWebServerConfig(path string) (*WebServerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &WebServerConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for user, hash := range config.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s: basic_auth_users: password of %s is not a bcrypt hash: %s", path, user, err)
+		}
+	}
+	if _, err := config.TLSServerConfig.tlsConfig(); err != nil {
+		return nil, fmt.Errorf("%s: tls_server_config: %s", path, err)
+	}
+	return config, nil
+}
+
+// Returns the TLS configuration of the server, nil if TLS is disabled
+func (c *TLSServerConfig) tlsConfig() (*tls.Config, error) {
+	if c.CertFile == "" && c.KeyFile == "" {
+		if c.ClientCAFile != "" || c.ClientAuthType != "" {
+			return nil, errors.New("client certificates require cert_file and key_file")
+		}
+		return nil, nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("both cert_file and key_file are required")
+	}
+	// The certificate is loaded again by the server, so that errors are reported at startup
+	if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		return nil, err
+	}
+	authType, ok := clientAuthTypes[c.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %s", c.ClientAuthType)
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: authType,
+	}
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client_ca_file %s", c.ClientCAFile)
+		}
+		if c.ClientAuthType == "" {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// Compared against for unknown users, so that their requests take as long as those of known users
+var (
+	unknownUserHashOnce sync.Once
+	unknownUserHashData []byte
+)
+
+// Returns the hash for unknown users, only computed on the first request of an unknown user
+func unknownUserHash() []byte {
+	unknownUserHashOnce.Do(func() {
+		unknownUserHashData, _ = bcrypt.GenerateFromPassword([]byte("unknown"), bcrypt.DefaultCost)
+	})
+	return unknownUserHashData
+}
+
+// Successful authentications remembered by a basicAuthHandler, the cache is cleared once full
+const authCacheSize = 100
+
+/*
+ * Requires the users to authenticate with their bcrypt hashed passwords.
+ * The comparison of a bcrypt hash takes long by design, so successful
+ * authentications are cached by the user and the SHA-256 hash of the
+ * password, like the Prometheus exporters do, and every scrape of the
+ * same user only compares the hash once.
+ */
+func basicAuthHandler(users map[string]string, handler http.Handler) http.Handler {
+	var mu sync.Mutex
+	authenticated := make(map[string]bool)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if ok {
+			sum := sha256.Sum256([]byte(password))
+			key := user + ":" + hex.EncodeToString(sum[:])
+			mu.Lock()
+			cached := authenticated[key]
+			mu.Unlock()
+			if cached {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			hash, known := users[user]
+			if !known {
+				hash = string(unknownUserHash())
+			}
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil && known {
+				mu.Lock()
+				if len(authenticated) >= authCacheSize {
+					authenticated = make(map[string]bool)
+				}
+				authenticated[key] = true
+				mu.Unlock()
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="Slurm Exporter"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+/*
+ * The WebServer serves the handler over HTTP, or over HTTPS with optional
+ * client certificates and basic authentication if configured by the web
+ * configuration file.
+ */
+type WebServer struct {
+	server *http.Server
+	tls    bool
+}
+
+func NewWebServer(handler http.Handler, configFile string) (*WebServer, error) {
+	ws := &WebServer{server: &http.Server{Handler: handler}}
+	if configFile == "" {
+		return ws, nil
+	}
+	config, err := LoadWebServerConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.BasicAuthUsers) > 0 {
+		ws.server.Handler = basicAuthHandler(config.BasicAuthUsers, handler)
+	}
+	ws.server.TLSConfig, err = config.TLSServerConfig.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if ws.server.TLSConfig != nil {
+		// The certificate is read on every handshake, so that it can be renewed without a restart
+		tlsConfig := config.TLSServerConfig
+		ws.server.TLSConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+			return &cert, err
+		}
+		ws.tls = true
+	}
+	return ws, nil
+}
+
+func (ws *WebServer) Serve(l net.Listener) error {
+	if ws.tls {
+		return ws.server.ServeTLS(l, "", "")
+	}
+	return ws.server.Serve(l)
+}
+
+// Stop accepting connections and wait for the requests in flight until the context is done
+func (ws *WebServer) Shutdown(ctx context.Context) error {
+	return ws.server.Shutdown(ctx)
+}
+
+func (ws *WebServer) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return ws.Serve(l)
+}
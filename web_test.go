@@ -0,0 +1,204 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Writes a certificate and its key signed by the parent, self-signed without parent
+func writeTestCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestWebServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCertificate(t, dir, "ca", nil, nil)
+	writeTestCertificate(t, dir, "server", ca, caKey)
+	writeTestCertificate(t, dir, "client", ca, caKey)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := "tls_server_config:\n" +
+		"  cert_file: " + filepath.Join(dir, "server.crt") + "\n" +
+		"  key_file: " + filepath.Join(dir, "server.key") + "\n" +
+		"  client_ca_file: " + filepath.Join(dir, "ca.crt") + "\n" +
+		"basic_auth_users:\n" +
+		"  prometheus: " + string(hash) + "\n"
+	configFile := filepath.Join(dir, "web.yml")
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewWebServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	}), configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+	url := "https://" + l.Addr().String() + "/metrics"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(certs []tls.Certificate, user, password string) (int, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		req, _ := http.NewRequest("GET", url, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if _, err := get(nil, "prometheus", "secret"); err == nil {
+		t.Error("Expected the handshake to fail without a client certificate")
+	}
+	for _, c := range []struct {
+		user, password string
+		status         int
+	}{
+		{"prometheus", "secret", http.StatusOK},
+		{"prometheus", "wrong", http.StatusUnauthorized},
+		{"unknown", "secret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		status, err := get([]tls.Certificate{clientCert}, c.user, c.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != c.status {
+			t.Errorf("Expected status %d for user %q with password %q, got %d", c.status, c.user, c.password, status)
+		}
+	}
+}
+
+func TestBasicAuthCache(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]string{"prometheus": string(hash)}
+	handler := basicAuthHandler(users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(user, password string) int {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if status := get("prometheus", "secret"); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	// Only the hash of the first successful request is compared
+	users["prometheus"] = "invalid"
+	if status := get("prometheus", "secret"); status != http.StatusOK {
+		t.Errorf("Expected the authentication to be cached, got status %d", status)
+	}
+	if status := get("prometheus", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a wrong password, got %d", status)
+	}
+}
+
+func TestInvalidWebServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, config := range []string{
+		"basic_auth_users:\n  prometheus: secret\n",
+		"tls_server_config:\n  cert_file: server.crt\n",
+		"tls_server_config:\n  client_ca_file: ca.crt\n",
+		"tls_server_config:\n  cert_file: missing.crt\n  key_file: missing.key\n",
+		"tls_config:\n  cert_file: server.crt\n",
+	} {
+		file := filepath.Join(dir, "web.yml")
+		ioutil.WriteFile(file, []byte(config), 0600)
+		if _, err := LoadWebServerConfig(file); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+}